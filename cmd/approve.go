@@ -0,0 +1,372 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// approvalRequest is a discharge request awaiting a decision. Its condition
+// is redacted, so that listing requests does not reveal any arguments.
+type approvalRequest struct {
+	ID         int       `json:"id"`
+	Condition  string    `json:"condition"`
+	RemoteAddr string    `json:"remote-addr"`
+	Requested  time.Time `json:"requested"`
+
+	decision chan bool
+}
+
+// redactCondition returns the name of a condition, without its arguments,
+// followed by a short digest of the whole condition.
+func redactCondition(condition string) string {
+	fields := strings.Fields(condition)
+	if len(fields) == 0 {
+		return conditionID(condition)
+	}
+	return fields[0] + " " + conditionID(condition)
+}
+
+// approvalQueue is a dischargeChecker which holds each discharge request
+// until it is granted or denied by an operator, or times out. Discharges for
+// granted requests expire after grantTTL, so that each approval grants access
+// for a short time only, even if the discharge is bound into an auth.
+type approvalQueue struct {
+	timeout  time.Duration
+	grantTTL time.Duration
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[int]*approvalRequest
+}
+
+func newApprovalQueue(timeout, grantTTL time.Duration) *approvalQueue {
+	return &approvalQueue{
+		timeout:  timeout,
+		grantTTL: grantTTL,
+		nextID:   1,
+		pending:  make(map[int]*approvalRequest),
+	}
+}
+
+func (q *approvalQueue) checkCondition(req *http.Request, condition string) ([]checkers.Caveat, error) {
+	q.mu.Lock()
+	r := &approvalRequest{
+		ID:         q.nextID,
+		Condition:  redactCondition(condition),
+		RemoteAddr: req.RemoteAddr,
+		Requested:  time.Now(),
+		decision:   make(chan bool, 1),
+	}
+	q.nextID++
+	q.pending[r.ID] = r
+	q.mu.Unlock()
+	log.Printf("approval %d: %s requests %s", r.ID, r.RemoteAddr, r.Condition)
+
+	var granted bool
+	select {
+	case granted = <-r.decision:
+	case <-time.After(q.timeout):
+		// A decision may have been made since the timer fired. Whichever
+		// of us removes the request from pending wins.
+		q.mu.Lock()
+		_, ok := q.pending[r.ID]
+		delete(q.pending, r.ID)
+		q.mu.Unlock()
+		if ok {
+			log.Printf("approval %d: timed out", r.ID)
+			return nil, fmt.Errorf("timed out waiting for approval")
+		}
+		granted = <-r.decision
+	}
+	if !granted {
+		return nil, fmt.Errorf("denied")
+	}
+	return []checkers.Caveat{checkers.TimeBeforeCaveat(time.Now().Add(q.grantTTL))}, nil
+}
+
+// list returns the pending requests in the order they were made.
+func (q *approvalQueue) list() []approvalRequest {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var reqs []approvalRequest
+	for _, r := range q.pending {
+		reqs = append(reqs, *r)
+	}
+	sort.Sort(approvalRequestsByID(reqs))
+	return reqs
+}
+
+// errApprovalNotPending is returned when deciding a request which has
+// already been decided, or has timed out.
+type errApprovalNotPending int
+
+func (e errApprovalNotPending) Error() string {
+	return fmt.Sprintf("approval %d no longer pending: already decided or timed out", int(e))
+}
+
+// decide grants or denies a pending request. The request is removed from
+// pending and its decision sent while holding the lock, so a decision is
+// either delivered, or reported as too late.
+func (q *approvalQueue) decide(id int, grant bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	r, ok := q.pending[id]
+	if !ok {
+		if id > 0 && id < q.nextID {
+			return errApprovalNotPending(id)
+		}
+		return fmt.Errorf("approval %d not found", id)
+	}
+	delete(q.pending, id)
+	r.decision <- grant
+	return nil
+}
+
+type approvalRequestsByID []approvalRequest
+
+func (s approvalRequestsByID) Len() int           { return len(s) }
+func (s approvalRequestsByID) Less(i, j int) bool { return s[i].ID < s[j].ID }
+func (s approvalRequestsByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// serveApprovals returns a handler which lists pending requests on GET
+// /approvals, and decides them on POST /approvals/grant?id=<id> and
+// /approvals/deny?id=<id>. Requests must carry the token written to OO_HOME
+// by the approve-server.
+func (q *approvalQueue) serveApprovals(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reqToken := strings.TrimPrefix(req.Header.Get("Authorization"), "Token ")
+		if subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case req.Method == "GET" && req.URL.Path == "/approvals":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(q.list())
+		case req.Method == "POST" && (req.URL.Path == "/approvals/grant" || req.URL.Path == "/approvals/deny"):
+			id, err := strconv.Atoi(req.URL.Query().Get("id"))
+			if err != nil {
+				http.Error(w, "invalid id", http.StatusBadRequest)
+				return
+			}
+			grant := req.URL.Path == "/approvals/grant"
+			err = q.decide(id, grant)
+			if err != nil {
+				code := http.StatusNotFound
+				if _, ok := err.(errApprovalNotPending); ok {
+					code = http.StatusConflict
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+			log.Printf("approval %d: granted=%v", id, grant)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+}
+
+func approvalTokenPath(ctx Context) (string, error) {
+	home, err := keyManager{ctx}.homeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "approve-token"), nil
+}
+
+type approveServerCommand struct{}
+
+// NewApproveServerCommand returns a Command that serves discharges for
+// third-party caveats once an operator approves them.
+func NewApproveServerCommand() *approveServerCommand {
+	return &approveServerCommand{}
+}
+
+// CLICommand implements Command.
+func (c *approveServerCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "approve-server",
+		Usage:  "serve discharges for third-party caveats once approved",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name:  "listen",
+				Usage: "address to listen on",
+				Value: "127.0.0.1:8081",
+			},
+			cli.StringFlag{
+				Name:  "location",
+				Usage: "URL at which clients reach this service, if not http://<listen>",
+			},
+			cli.StringFlag{
+				Name:  "timeout",
+				Usage: "how long a request waits for approval",
+				Value: "5m",
+			},
+			cli.StringFlag{
+				Name:  "grant-ttl",
+				Usage: "how long the discharge for an approved request is valid",
+				Value: "1m",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *approveServerCommand) Do(ctx Context) error {
+	timeout, err := time.ParseDuration(ctx.String("timeout"))
+	if err != nil {
+		return fmt.Errorf("invalid --timeout: %v", err)
+	}
+	grantTTL, err := time.ParseDuration(ctx.String("grant-ttl"))
+	if err != nil || grantTTL <= 0 {
+		return fmt.Errorf("invalid --grant-ttl %q", ctx.String("grant-ttl"))
+	}
+	queue := newApprovalQueue(timeout, grantTTL)
+	mux, err := newDischargeHandler(ctx, "/", queue)
+	if err != nil {
+		return err
+	}
+
+	tokenPath, err := approvalTokenPath(ctx)
+	if err != nil {
+		return err
+	}
+	tokenBytes := make([]byte, 16)
+	_, err = rand.Reader.Read(tokenBytes)
+	if err != nil {
+		return err
+	}
+	token := hex.EncodeToString(tokenBytes)
+	err = ioutil.WriteFile(tokenPath, []byte(token), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write approval token: %v", err)
+	}
+	mux.Handle("/approvals", queue.serveApprovals(token))
+	mux.Handle("/approvals/", queue.serveApprovals(token))
+
+	listen := ctx.String("listen")
+	log.Printf("listening for discharge requests on %s", listen)
+	return http.ListenAndServe(listen, mux)
+}
+
+type approvalsCommand struct{}
+
+// NewApprovalsCommand returns a Command that lists, grants and denies
+// discharge requests pending on an approve-server.
+func NewApprovalsCommand() *approvalsCommand {
+	return &approvalsCommand{}
+}
+
+// CLICommand implements Command.
+func (c *approvalsCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "approvals",
+		Usage:  "list, grant or deny pending approvals: approvals list|grant <id>|deny <id>",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name:  "url",
+				Usage: "location of approve-server",
+				Value: "http://127.0.0.1:8081",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *approvalsCommand) Do(ctx Context) error {
+	args := ctx.Args()
+	if len(args) == 0 {
+		ctx.ShowAppHelp()
+		return errors.New("missing approvals command")
+	}
+	tokenPath, err := approvalTokenPath(ctx)
+	if err != nil {
+		return err
+	}
+	token, err := ioutil.ReadFile(tokenPath)
+	if err != nil {
+		return fmt.Errorf("failed to read approval token: %v", err)
+	}
+	urlStr := strings.TrimSuffix(ctx.String("url"), "/")
+
+	var req *http.Request
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		req, err = http.NewRequest("GET", urlStr+"/approvals", nil)
+	case (args[0] == "grant" || args[0] == "deny") && len(args) == 2:
+		req, err = http.NewRequest("POST", urlStr+"/approvals/"+args[0]+"?id="+args[1], nil)
+	default:
+		ctx.ShowAppHelp()
+		return fmt.Errorf("invalid approvals command %q", strings.Join(args, " "))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create request %q: %v", urlStr, err)
+	}
+	req.Header.Set("Authorization", "Token "+string(token))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error requesting %q: %v", urlStr, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusOK:
+		var reqs []approvalRequest
+		err = json.NewDecoder(resp.Body).Decode(&reqs)
+		if err != nil {
+			return fmt.Errorf("invalid response: %v", err)
+		}
+		for _, r := range reqs {
+			fmt.Fprintf(ctx.Stdout(), "%d\t%s\t%s\t%s\n", r.ID,
+				r.Requested.Format(time.RFC3339), r.RemoteAddr, r.Condition)
+		}
+		return nil
+	}
+	return errHTTPResponse(resp)
+}
@@ -0,0 +1,284 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveContentTypes maps the archive formats supported by --archive-format
+// to the content type recorded for them.
+var archiveContentTypes = map[string]string{
+	"tar":     "application/x-tar",
+	"tar.gz":  "application/x-tar+gzip",
+	"tar.zst": "application/x-tar+zstd",
+}
+
+// Limits on what extractArchive will write, so that a compression bomb, or
+// an archive of a great many small entries, is refused before it fills the
+// disk.
+var (
+	maxArchiveSize    int64 = maxDecompressedSize
+	maxArchiveEntries       = 1 << 16
+)
+
+func isArchive(contentType string) bool {
+	for _, ct := range archiveContentTypes {
+		if ct == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveDir returns a tar archive of the contents of dir, compressed
+// according to format, along with its content type.
+func archiveDir(dir, format string) (io.ReadCloser, string, error) {
+	contentType, ok := archiveContentTypes[format]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported archive format %q", format)
+	}
+
+	var buf bytes.Buffer
+	var w io.WriteCloser = nopWriteCloser{&buf}
+	var err error
+	switch format {
+	case "tar.gz":
+		w = gzip.NewWriter(&buf)
+	case "tar.zst":
+		w, err = zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	tw := tar.NewWriter(w)
+
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to archive %q: %v", dir, err)
+	}
+	err = tw.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, "", err
+	}
+	return ioutil.NopCloser(&buf), contentType, nil
+}
+
+// extractArchive extracts the archive read from r into dest. Entries which
+// would be written outside of dest, such as absolute paths, paths containing
+// "..", links pointing out of dest, or paths through a link, are refused.
+// Extraction fails once the archive exceeds maxArchiveSize bytes
+// decompressed, or maxArchiveEntries entries.
+func extractArchive(r io.Reader, contentType, dest string) error {
+	switch contentType {
+	case archiveContentTypes["tar"]:
+	case archiveContentTypes["tar.gz"]:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case archiveContentTypes["tar.zst"]:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return fmt.Errorf("cannot extract content type %q", contentType)
+	}
+
+	err := os.MkdirAll(dest, 0700)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(&archiveLimitReader{r: r, n: maxArchiveSize})
+	for entries := 0; ; entries++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if entries == maxArchiveEntries {
+			return fmt.Errorf("archive exceeds %d entries", maxArchiveEntries)
+		}
+		name, err := archivePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		err = checkNoLinks(dest, name)
+		if err != nil {
+			return fmt.Errorf("refusing to extract %q: %v", hdr.Name, err)
+		}
+		target := filepath.Join(dest, name)
+		mode := os.FileMode(hdr.Mode) & os.ModePerm
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(target, mode, tr)
+		case tar.TypeSymlink:
+			linkName := hdr.Linkname
+			if !path.IsAbs(linkName) {
+				linkName = path.Join(path.Dir(hdr.Name), linkName)
+			}
+			if _, err = archivePath(linkName); err != nil {
+				return fmt.Errorf("refusing to extract %q: link to %q leaves destination", hdr.Name, hdr.Linkname)
+			}
+			err = os.Symlink(hdr.Linkname, target)
+		default:
+			return fmt.Errorf("refusing to extract %q: unsupported entry type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archivePath validates an archive entry name, returning it as a relative
+// local path.
+func archivePath(name string) (string, error) {
+	if path.IsAbs(name) || strings.HasPrefix(name, `\`) {
+		return "", fmt.Errorf("refusing to extract %q: absolute path", name)
+	}
+	clean := path.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("refusing to extract %q: path leaves destination", name)
+	}
+	return filepath.FromSlash(clean), nil
+}
+
+// checkNoLinks returns an error if any existing component of name, a relative
+// path under dest, is a symbolic link. Links are only checked lexically when
+// they are extracted, so a chain of them could otherwise lead out of dest.
+func checkNoLinks(dest, name string) error {
+	p := dest
+	for _, elem := range strings.Split(name, string(filepath.Separator)) {
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("path through link %q", p)
+		}
+	}
+	return nil
+}
+
+func extractFile(target string, mode os.FileMode, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(target), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// archiveLimitReader reads from r, failing once more than n bytes have been
+// read.
+type archiveLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *archiveLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, fmt.Errorf("archive exceeds %d bytes", maxArchiveSize)
+	}
+	return n, err
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
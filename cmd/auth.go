@@ -0,0 +1,241 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"gopkg.in/macaroon.v1"
+)
+
+// Auth formats, given to --auth-format. Input auths in any format are
+// recognized automatically.
+const (
+	// authJSON is the JSON encoding of a macaroon slice.
+	authJSON = "json"
+
+	// authB64 is the binary encoding of a macaroon slice in unpadded
+	// URL-safe base64, on a single line.
+	authB64 = "b64"
+
+	// authArmor is the binary encoding of a macaroon slice in base64,
+	// wrapped between BEGIN and END lines, with a CRC-24 checksum as in
+	// OpenPGP ASCII armor.
+	authArmor = "armor"
+
+	// authBinary is the binary encoding of a macaroon slice, unencoded.
+	authBinary = "binary"
+)
+
+const (
+	armorBegin = "-----BEGIN OO AUTH-----"
+	armorEnd   = "-----END OO AUTH-----"
+)
+
+// authEncoding is how auths are output: the format, and the macaroon
+// serialization version used within it.
+type authEncoding struct {
+	format  string
+	version int
+}
+
+// authFormat returns the encoding given by --auth-format, which defaults to
+// json, and --macaroon-version, which defaults to 1. Existing oostore
+// services only accept version 1.
+func authFormat(ctx Context) (authEncoding, error) {
+	enc := authEncoding{format: ctx.String("auth-format"), version: 1}
+	switch enc.format {
+	case "":
+		enc.format = authJSON
+	case authJSON, authB64, authArmor, authBinary:
+	default:
+		return enc, fmt.Errorf("invalid --auth-format %q, expected json, b64, armor or binary", enc.format)
+	}
+	switch v := ctx.String("macaroon-version"); v {
+	case "", "1":
+	case "2":
+		enc.version = 2
+	default:
+		return enc, fmt.Errorf("invalid --macaroon-version %q, expected 1 or 2", v)
+	}
+	return enc, nil
+}
+
+// encodeAuth writes ms to w in the given encoding. Text formats are followed
+// by a newline.
+func encodeAuth(w io.Writer, ms macaroon.Slice, enc authEncoding) error {
+	if enc.format == authJSON {
+		if enc.version == 2 {
+			buf, err := marshalJSONV2(ms)
+			if err != nil {
+				return fmt.Errorf("failed to encode auth: %v", err)
+			}
+			_, err = fmt.Fprintf(w, "%s\n", buf)
+			return err
+		}
+		return json.NewEncoder(w).Encode(ms)
+	}
+	var buf []byte
+	var err error
+	if enc.version == 2 {
+		buf, err = marshalBinaryV2(ms)
+	} else {
+		buf, err = ms.MarshalBinary()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode auth: %v", err)
+	}
+	switch enc.format {
+	case authBinary:
+		_, err = w.Write(buf)
+		return err
+	case authB64:
+		_, err = fmt.Fprintln(w, base64.RawURLEncoding.EncodeToString(buf))
+		return err
+	}
+
+	var armor bytes.Buffer
+	fmt.Fprintln(&armor, armorBegin)
+	fmt.Fprintln(&armor)
+	encoded := base64.StdEncoding.EncodeToString(buf)
+	for len(encoded) > 64 {
+		fmt.Fprintln(&armor, encoded[:64])
+		encoded = encoded[64:]
+	}
+	fmt.Fprintln(&armor, encoded)
+	crc := crc24(buf)
+	fmt.Fprintln(&armor, "="+base64.StdEncoding.EncodeToString([]byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}))
+	fmt.Fprintln(&armor, armorEnd)
+	_, err = w.Write(armor.Bytes())
+	return err
+}
+
+// unmarshalAuth reads an auth in any of the auth formats, with macaroons in
+// either version.
+func unmarshalAuth(r io.Reader) (macaroon.Slice, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input: %v", err)
+	}
+	var ms macaroon.Slice
+	if isBinaryAuth(buf) {
+		ms, err = unmarshalBinary(buf)
+	} else {
+		buf = bytes.TrimSpace(buf)
+		switch {
+		case bytes.HasPrefix(buf, []byte("[")):
+			ms, err = unmarshalJSON(buf)
+		case bytes.HasPrefix(buf, []byte(armorBegin)):
+			var bin []byte
+			bin, err = dearmor(string(buf))
+			if err == nil {
+				ms, err = unmarshalBinary(bin)
+			}
+		default:
+			var bin []byte
+			bin, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(string(buf), "="))
+			if err == nil {
+				ms, err = unmarshalBinary(bin)
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode auth: %v", err)
+	}
+	return ms, nil
+}
+
+// isBinaryAuth returns whether buf is an unencoded binary auth: a version 2
+// macaroon, or a version 1 macaroon starting with its location packet.
+func isBinaryAuth(buf []byte) bool {
+	if len(buf) > 0 && buf[0] == 2 {
+		return true
+	}
+	if len(buf) < 13 {
+		return false
+	}
+	if _, err := strconv.ParseUint(string(buf[:4]), 16, 16); err != nil {
+		return false
+	}
+	return string(buf[4:13]) == "location "
+}
+
+func unmarshalBinary(buf []byte) (macaroon.Slice, error) {
+	if len(buf) > 0 && buf[0] == 2 {
+		return unmarshalBinaryV2(buf)
+	}
+	var ms macaroon.Slice
+	err := ms.UnmarshalBinary(buf)
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// dearmor returns the contents of an armored auth, after checking its
+// checksum.
+func dearmor(s string) ([]byte, error) {
+	lines := strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n")
+	if len(lines) < 3 || lines[0] != armorBegin || strings.TrimSpace(lines[len(lines)-1]) != armorEnd {
+		return nil, errors.New("malformed armor")
+	}
+	var body, checksum string
+	for _, line := range lines[1 : len(lines)-1] {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "=") {
+			checksum = line[1:]
+			continue
+		}
+		body += line
+	}
+	buf, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, fmt.Errorf("malformed armor: %v", err)
+	}
+	sum, err := base64.StdEncoding.DecodeString(checksum)
+	if err != nil || len(sum) != 3 {
+		return nil, errors.New("malformed armor checksum")
+	}
+	crc := crc24(buf)
+	if sum[0] != byte(crc>>16) || sum[1] != byte(crc>>8) || sum[2] != byte(crc) {
+		return nil, errors.New("armor checksum mismatch")
+	}
+	return buf, nil
+}
+
+// crc24 returns the OpenPGP CRC-24 of buf (RFC 4880, section 6.1).
+func crc24(buf []byte) uint32 {
+	crc := uint32(0xb704ce)
+	for _, b := range buf {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	return crc & 0xffffff
+}
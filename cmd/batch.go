@@ -0,0 +1,333 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon.v1"
+)
+
+type batchCommand struct{}
+
+// NewBatchCommand returns a Command that runs many operations from a manifest
+// over a shared client.
+func NewBatchCommand() *batchCommand {
+	return &batchCommand{}
+}
+
+// CLICommand implements Command.
+func (c *batchCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "batch",
+		Usage:  "run new, fetch and delete operations from a manifest",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "url",
+				EnvVar: "OOSTORE_URL",
+				Value:  defaultURL,
+			},
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name:  "input, i",
+				Usage: "manifest of operations, one JSON object per line",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Usage: "results, one JSON object per line",
+			},
+			cli.StringFlag{
+				Name:  "workers, w",
+				Usage: "number of operations to run in parallel",
+				Value: "4",
+			},
+		},
+	}
+}
+
+// batchItem is an operation in a batch manifest.
+type batchItem struct {
+	// Op is the operation to perform: new, fetch or delete.
+	Op string `json:"op"`
+
+	// Input is the file to read: contents for new, auth for fetch and
+	// delete.
+	Input string `json:"input"`
+
+	// Output is the file to write: auth for new, contents for fetch.
+	Output string `json:"output,omitempty"`
+
+	// Caveats are first-party caveat conditions added to the auth, before
+	// it is written for new, or before it is used for fetch and delete.
+	Caveats []string `json:"caveats,omitempty"`
+}
+
+// batchResult reports the outcome of a batchItem.
+type batchResult struct {
+	Item   int    `json:"item"`
+	Op     string `json:"op"`
+	Input  string `json:"input"`
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Do implements Command.
+func (c *batchCommand) Do(ctx Context) error {
+	var (
+		input io.ReadCloser
+		err   error
+	)
+
+	workers, err := strconv.Atoi(ctx.String("workers"))
+	if err != nil || workers < 1 {
+		return fmt.Errorf("invalid --workers %q", ctx.String("workers"))
+	}
+
+	inputFile := ctx.String("input")
+	if inputFile == "" {
+		input = ctx.Stdin()
+	} else {
+		input, err = os.Open(inputFile)
+		if err != nil {
+			return fmt.Errorf("cannot open %q for input: %v", inputFile, err)
+		}
+	}
+	defer input.Close()
+
+	var items []batchItem
+	scanner := bufio.NewScanner(input)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var item batchItem
+		err = json.Unmarshal(scanner.Bytes(), &item)
+		if err != nil {
+			return fmt.Errorf("invalid manifest line %d: %v", line, err)
+		}
+		items = append(items, item)
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	s, err := newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	s.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			MaxIdleConnsPerHost: workers,
+		},
+	}
+
+	results := make([]batchResult, len(items))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				item := &items[i]
+				results[i] = batchResult{Item: i + 1, Op: item.Op, Input: item.Input, Output: item.Output}
+				if err := s.runBatchItem(item); err != nil {
+					results[i].Error = err.Error()
+				}
+			}
+		}()
+	}
+	for i := range items {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	var failed int
+	err = writeCtxOutput(ctx, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for i := range results {
+			if results[i].Error != "" {
+				failed++
+			}
+			err := enc.Encode(&results[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d operations failed", failed, len(results))
+	}
+	return nil
+}
+
+func (s *session) runBatchItem(item *batchItem) error {
+	switch item.Op {
+	case "new":
+		if item.Output == "" {
+			return fmt.Errorf("missing output")
+		}
+		input, err := os.Open(item.Input)
+		if err != nil {
+			return err
+		}
+		ms, err := s.create(input, metadata{}, &s.key.Public)
+		if err != nil {
+			return err
+		}
+		err = addCaveats(ms, item.Caveats)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(item.Output, 0600, false, func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(ms)
+		})
+	case "fetch":
+		if item.Output == "" {
+			return fmt.Errorf("missing output")
+		}
+		ms, err := readAuthFile(item.Input, item.Caveats)
+		if err != nil {
+			return err
+		}
+		contents, env, err := s.fetch(ms)
+		if err != nil {
+			return err
+		}
+		env.wipe()
+		defer destroyReader(contents)
+		return writeFileAtomic(item.Output, 0600, false, func(w io.Writer) error {
+			_, err := io.Copy(w, contents)
+			return err
+		})
+	case "delete":
+		ms, err := readAuthFile(item.Input, item.Caveats)
+		if err != nil {
+			return err
+		}
+		return s.delete(ms)
+	}
+	return fmt.Errorf("unknown operation %q", item.Op)
+}
+
+func readAuthFile(authFile string, caveats []string) (macaroon.Slice, error) {
+	f, err := os.Open(authFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ms, err := unmarshalAuth(f)
+	if err != nil {
+		return nil, err
+	}
+	err = addCaveats(ms, caveats)
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+func addCaveats(ms macaroon.Slice, caveats []string) error {
+	if len(caveats) == 0 {
+		return nil
+	}
+	if len(ms) == 0 {
+		return fmt.Errorf("missing auth")
+	}
+	for _, caveat := range caveats {
+		err := ms[0].AddFirstPartyCaveat(caveat)
+		if err != nil {
+			return fmt.Errorf("failed to add caveat: %v", err)
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes a file by way of a temporary file in the same
+// directory, created with the given mode, which is synced and renamed into
+// place only if write succeeds. Otherwise the temporary file is removed, and
+// any existing file at path is left as it was. If noClobber is set, an
+// existing file at path is never replaced.
+func writeFileAtomic(path string, mode os.FileMode, noClobber bool, write func(io.Writer) error) error {
+	if noClobber {
+		if _, err := os.Lstat(path); err == nil {
+			return fmt.Errorf("%q already exists", path)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	dir := filepath.Dir(path)
+	// TempFile creates the file with mode 0600, so the contents are never
+	// readable by others before the mode is set.
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	err = f.Chmod(mode)
+	if err == nil {
+		err = write(f)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		if noClobber {
+			// Link fails if path was created in the meantime, where
+			// rename would replace it.
+			err = os.Link(tmpPath, path)
+		} else {
+			err = os.Rename(tmpPath, path)
+		}
+	}
+	os.Remove(tmpPath)
+	if err != nil {
+		return err
+	}
+	// Sync the directory, so the new entry is durable too.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+)
+
+// dischargeCache stores third-party discharge macaroons in OO_HOME, so that
+// repeated requests on the same auth do not each need a new discharge. Only
+// discharges which expire, with a time-before caveat, are cached, and only
+// until they expire. Whether a discharge may be reused is up to the
+// discharger.
+type dischargeCache struct {
+	dir string
+}
+
+func newDischargeCache(ctx Context) (*dischargeCache, error) {
+	home, err := keyManager{ctx}.homeDir()
+	if err != nil {
+		return nil, err
+	}
+	return &dischargeCache{dir: filepath.Join(home, "discharges")}, nil
+}
+
+func (c *dischargeCache) path(caveatId string) string {
+	sum := sha256.Sum256([]byte(caveatId))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// get returns the cached discharge for a caveat, or nil if there is no
+// unexpired discharge for it.
+func (c *dischargeCache) get(caveatId string) *macaroon.Macaroon {
+	p := c.path(caveatId)
+	buf, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	var m macaroon.Macaroon
+	err = json.Unmarshal(buf, &m)
+	if err != nil {
+		os.Remove(p)
+		return nil
+	}
+	expiry, ok := dischargeExpiry(&m)
+	if !ok || !time.Now().Before(expiry) {
+		os.Remove(p)
+		return nil
+	}
+	return &m
+}
+
+// put caches a discharge for a caveat, if it expires.
+func (c *dischargeCache) put(caveatId string, m *macaroon.Macaroon) error {
+	if _, ok := dischargeExpiry(m); !ok {
+		return nil
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(c.dir, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(c.dir, ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(caveatId))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// clear removes all cached discharges.
+func (c *dischargeCache) clear() error {
+	return os.RemoveAll(c.dir)
+}
+
+// dischargeExpiry returns the earliest time-before condition in m's caveats.
+// ok is false if m has no time-before caveat.
+func dischargeExpiry(m *macaroon.Macaroon) (expiry time.Time, ok bool) {
+	for _, cav := range m.Caveats() {
+		if cav.Location != "" {
+			continue
+		}
+		cond, arg, err := checkers.ParseCaveat(cav.Id)
+		if err != nil || cond != checkers.CondTimeBefore {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, arg)
+		if err != nil {
+			continue
+		}
+		if !ok || t.Before(expiry) {
+			expiry, ok = t, true
+		}
+	}
+	return expiry, ok
+}
+
+type cacheCommand struct{}
+
+// NewCacheCommand returns a Command that manages the discharge cache.
+func NewCacheCommand() *cacheCommand {
+	return &cacheCommand{}
+}
+
+// CLICommand implements Command.
+func (c *cacheCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "cache",
+		Usage:  "manage cached discharges: cache clear",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *cacheCommand) Do(ctx Context) error {
+	args := ctx.Args()
+	if len(args) != 1 || args[0] != "clear" {
+		ctx.ShowAppHelp()
+		return errors.New("usage: cache clear")
+	}
+	cache, err := newDischargeCache(ctx)
+	if err != nil {
+		return err
+	}
+	err = cache.clear()
+	if err != nil {
+		return fmt.Errorf("failed to clear cache: %v", err)
+	}
+	return nil
+}
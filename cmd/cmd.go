@@ -26,6 +26,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"gopkg.in/macaroon-bakery.v1/bakery"
@@ -127,14 +128,21 @@ func errHTTPResponse(resp *http.Response) error {
 	var body bytes.Buffer
 	_, err := io.Copy(&body, resp.Body)
 	if err != nil {
-		log.Println("error reading response: %v", err)
+		log.Printf("error reading response: %v", err)
 	}
 	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(body.String()))
 }
 
+// dischargeStatusInterval is how often a blocked discharge request reports
+// that it is still waiting.
+var dischargeStatusInterval = 10 * time.Second
+
 type dischargeAcquirer struct {
-	client *httpbakery.Client
-	env    *envelope
+	client         *httpbakery.Client
+	env            *envelope
+	timeout        time.Duration
+	cache          *dischargeCache
+	nonInteractive bool
 }
 
 // AcquireDischarge implements httpbakery.DischargeAcquirer.
@@ -144,37 +152,81 @@ func (da *dischargeAcquirer) AcquireDischarge(firstPartyLocation string, cav mac
 			bakery.ThirdPartyCheckerFunc(da.clientEncryptChecker), cav.Id)
 		return dm, err
 	}
-	return da.client.AcquireDischarge(firstPartyLocation, cav)
-}
-
-func (da *dischargeAcquirer) clientEncryptChecker(caveatId, caveat string) ([]checkers.Caveat, error) {
-	da.env = newEnvelope()
-	err := da.env.UnmarshalJSON([]byte(caveat))
+	if da.cache != nil {
+		if dm := da.cache.get(cav.Id); dm != nil {
+			return dm, nil
+		}
+	}
+	var dm *macaroon.Macaroon
+	var err error
+	if isTOTPLocation(cav.Location) {
+		dm, err = da.acquireTOTP(firstPartyLocation, cav)
+	} else {
+		dm, err = da.acquireRemote(firstPartyLocation, cav)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return nil, nil
+	if da.cache != nil {
+		if err := da.cache.put(cav.Id, dm); err != nil {
+			log.Printf("failed to cache discharge: %v", err)
+		}
+	}
+	return dm, nil
 }
 
-func dischargeAuth(ctx Context, ms macaroon.Slice) (macaroon.Slice, *envelope, error) {
-	if len(ms) != 1 {
-		return ms, nil, nil
+// acquireRemote requests a discharge from a third-party service. Services
+// such as an approve-server may hold the request for a while, so the wait is
+// reported periodically and abandoned after the timeout, if there is one.
+func (da *dischargeAcquirer) acquireRemote(firstPartyLocation string, cav macaroon.Caveat) (*macaroon.Macaroon, error) {
+	type result struct {
+		m   *macaroon.Macaroon
+		err error
 	}
-	mgr := keyManager{ctx}
-	kp, err := mgr.keyPair()
-	if err != nil {
-		return nil, nil, err
+	done := make(chan result, 1)
+	go func() {
+		m, err := da.client.AcquireDischarge(firstPartyLocation, cav)
+		done <- result{m, err}
+	}()
+
+	var timeout <-chan time.Time
+	if da.timeout > 0 {
+		timeout = time.After(da.timeout)
+	}
+	status := time.NewTicker(dischargeStatusInterval)
+	defer status.Stop()
+	start := time.Now()
+	for {
+		select {
+		case r := <-done:
+			return r.m, r.err
+		case <-status.C:
+			log.Printf("waiting for discharge from %s (%v)", cav.Location, time.Since(start)/time.Second*time.Second)
+		case <-timeout:
+			return nil, fmt.Errorf("timed out after %v waiting for discharge from %s", da.timeout, cav.Location)
+		}
 	}
+}
 
-	cl := httpbakery.NewClient()
-	da := &dischargeAcquirer{client: cl}
-	cl.DischargeAcquirer = da
-	cl.Key = kp.KeyPair
-	ms, err = cl.DischargeAll(ms[0])
+// openEnvelope recovers the envelope from a client:encrypt caveat without
+// keeping the discharge, for auths which already carry one.
+func (da *dischargeAcquirer) openEnvelope(cav macaroon.Caveat) error {
+	_, _, err := bakery.Discharge(da.client.Key,
+		bakery.ThirdPartyCheckerFunc(da.clientEncryptChecker), cav.Id)
+	return err
+}
+
+func (da *dischargeAcquirer) clientEncryptChecker(caveatId, caveat string) ([]checkers.Caveat, error) {
+	env := newEnvelope()
+	err := env.UnmarshalJSON([]byte(caveat))
 	if err != nil {
-		return nil, nil, err
+		env.wipe()
+		return nil, err
 	}
-	return ms, da.env, nil
+	// Only one envelope is kept; wipe any from an earlier caveat.
+	da.env.wipe()
+	da.env = env
+	return nil, nil
 }
 
 func objectID(ms macaroon.Slice) (string, error) {
@@ -17,14 +17,30 @@
 package cmd_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/cmars/oostore"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/macaroon.v1"
 	"gopkg.in/tomb.v2"
 
 	"github.com/cmars/ooclient/cmd"
@@ -116,6 +132,1818 @@ func (s *cmdSuite) TestDelete(c *gc.C) {
 	}), gc.ErrorMatches, `^404 Not Found.*`)
 }
 
+func (s *cmdSuite) TestRotate(c *gc.C) {
+	in := bytes.NewBufferString("hello world")
+	var oldAuth, newAuth, out bytes.Buffer
+	flags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": s.home,
+	}
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: flags,
+		stdin: in, stdout: &oldAuth,
+	}), gc.IsNil)
+	c.Assert(cmd.NewRotateCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(oldAuth.Bytes()), stdout: &newAuth,
+	}), gc.IsNil)
+	// the new auth fetches the same contents
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(newAuth.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "hello world")
+	// the original is gone
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(oldAuth.Bytes()),
+	}), gc.ErrorMatches, `^404 Not Found.*`)
+	// and can't be rotated again
+	c.Assert(cmd.NewRotateCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(oldAuth.Bytes()),
+	}), gc.ErrorMatches, `failed to fetch object: 404 Not Found.*`)
+}
+
+func (s *cmdSuite) TestRotateOutputFails(c *gc.C) {
+	var auth, out bytes.Buffer
+	flags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": s.home,
+	}
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBufferString("hello world"), stdout: &auth,
+	}), gc.IsNil)
+	c.Assert(cmd.NewRotateCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":    s.server.URL,
+			"home":   s.home,
+			"output": filepath.Join(c.MkDir(), "missing", "new.auth"),
+		},
+		stdin: bytes.NewBuffer(auth.Bytes()),
+	}), gc.ErrorMatches, `rotation failed: cannot write .*`)
+	// the original is kept when the new auth can't be written
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(auth.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "hello world")
+}
+
+func (s *cmdSuite) TestDischargeBundle(c *gc.C) {
+	in := bytes.NewBufferString("hello world")
+	var auth, bound, out bytes.Buffer
+	flags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": s.home,
+	}
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: flags,
+		stdin: in, stdout: &auth,
+	}), gc.IsNil)
+	boundFile := filepath.Join(c.MkDir(), "bound.auth")
+	c.Assert(cmd.NewDischargeCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":    s.server.URL,
+			"home":   s.home,
+			"output": boundFile,
+		},
+		stdin: bytes.NewBuffer(auth.Bytes()),
+	}), gc.IsNil)
+	fi, err := os.Stat(boundFile)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fi.Mode().Perm(), gc.Equals, os.FileMode(0600))
+	boundBytes, err := ioutil.ReadFile(boundFile)
+	c.Assert(err, gc.IsNil)
+	bound.Write(boundBytes)
+	// the bound auth still decrypts
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(bound.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "hello world")
+	// but not with another key
+	out.Reset()
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": c.MkDir(),
+		},
+		stdin: bytes.NewBuffer(bound.Bytes()), stdout: &out,
+	}), gc.ErrorMatches, `cannot decrypt contents: .*`)
+	c.Assert(out.Len(), gc.Equals, 0)
+	c.Assert(cmd.NewDeleteCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(bound.Bytes()),
+	}), gc.IsNil)
+}
+
+// startDischarger serves a discharge handler configured by flags, returning
+// the server, its public key and a count of the discharges requested.
+func (s *cmdSuite) startDischarger(c *gc.C, flags map[string]interface{}) (*httptest.Server, string, *int32) {
+	var handler http.Handler
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/discharge" {
+			atomic.AddInt32(&requests, 1)
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	flags["location"] = srv.URL
+	var err error
+	handler, err = cmd.NewDischargeHandler(&StubContext{flags: flags})
+	c.Assert(err, gc.IsNil)
+	resp, err := http.Get(srv.URL + "/publickey")
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	var pk struct {
+		PublicKey string
+	}
+	c.Assert(json.NewDecoder(resp.Body).Decode(&pk), gc.IsNil)
+	return srv, pk.PublicKey, &requests
+}
+
+// newCaveatedAuth returns the auth of a new object holding contents, with a
+// third-party caveat for condition addressed to location.
+func (s *cmdSuite) newCaveatedAuth(c *gc.C, contents, location, key, condition string) []byte {
+	var auth, caveated bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{"url": s.server.URL, "home": s.home},
+		stdin: bytes.NewBufferString(contents), stdout: &auth,
+	}), gc.IsNil)
+	c.Assert(cmd.NewCondCommand().Do(&StubContext{
+		args: []string{condition},
+		flags: map[string]interface{}{
+			"url":      s.server.URL,
+			"location": location,
+			"key":      key,
+		},
+		stdin: &auth, stdout: &caveated,
+	}), gc.IsNil)
+	return caveated.Bytes()
+}
+
+func (s *cmdSuite) TestDischargeCacheReuse(c *gc.C) {
+	// The time checker's discharges expire, so they are cached.
+	notAfter := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	srv, key, requests := s.startDischarger(c, map[string]interface{}{
+		"home":      s.home,
+		"checker":   "time",
+		"not-after": notAfter,
+	})
+	defer srv.Close()
+	auth := s.newCaveatedAuth(c, "hello world", srv.URL, key, "is-audited")
+	fetch := func(flags map[string]interface{}) {
+		flags["url"], flags["home"] = s.server.URL, s.home
+		var out bytes.Buffer
+		c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+			flags: flags,
+			stdin: bytes.NewBuffer(auth), stdout: &out,
+		}), gc.IsNil)
+		c.Assert(out.String(), gc.Equals, "hello world")
+	}
+
+	fetch(map[string]interface{}{})
+	c.Assert(atomic.LoadInt32(requests), gc.Equals, int32(1))
+	fetch(map[string]interface{}{})
+	c.Assert(atomic.LoadInt32(requests), gc.Equals, int32(1))
+	fetch(map[string]interface{}{"no-discharge-cache": true})
+	c.Assert(atomic.LoadInt32(requests), gc.Equals, int32(2))
+
+	c.Assert(cmd.NewCacheCommand().Do(&StubContext{
+		args:  []string{"clear"},
+		flags: map[string]interface{}{"home": s.home},
+	}), gc.IsNil)
+	_, err := os.Stat(filepath.Join(s.home, "discharges"))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+	fetch(map[string]interface{}{})
+	c.Assert(atomic.LoadInt32(requests), gc.Equals, int32(3))
+}
+
+func (s *cmdSuite) TestDischargeCacheExpiry(c *gc.C) {
+	cache, err := cmd.NewDischargeCache(&StubContext{
+		flags: map[string]interface{}{"home": s.home},
+	})
+	c.Assert(err, gc.IsNil)
+	discharge := func(id string, caveats ...string) *macaroon.Macaroon {
+		m, err := macaroon.New([]byte("root key"), id, "http://discharger")
+		c.Assert(err, gc.IsNil)
+		for _, cav := range caveats {
+			c.Assert(m.AddFirstPartyCaveat(cav), gc.IsNil)
+		}
+		return m
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+
+	// Discharges which expire are reused until they do.
+	m := discharge("fresh", "time-before "+future)
+	c.Assert(cache.Put("fresh", m), gc.IsNil)
+	cached := cache.Get("fresh")
+	c.Assert(cached, gc.NotNil)
+	c.Assert(cached.Signature(), gc.DeepEquals, m.Signature())
+	c.Assert(cache.Get("other"), gc.IsNil)
+
+	// Discharges which don't expire are not cached at all.
+	c.Assert(cache.Put("forever", discharge("forever")), gc.IsNil)
+	c.Assert(cache.Get("forever"), gc.IsNil)
+
+	// Expired discharges are removed.
+	c.Assert(cache.Put("stale", discharge("stale", "time-before "+past)), gc.IsNil)
+	c.Assert(cache.Get("stale"), gc.IsNil)
+	entries, err := ioutil.ReadDir(filepath.Join(s.home, "discharges"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 1)
+
+	c.Assert(cmd.NewCacheCommand().Do(&StubContext{
+		args:  []string{"clear"},
+		flags: map[string]interface{}{"home": s.home},
+	}), gc.IsNil)
+	c.Assert(cache.Get("fresh"), gc.IsNil)
+}
+
+func (s *cmdSuite) TestVisitWebPage(c *gc.C) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	u, err := url.Parse("http://discharger.example.com/visit?waitid=1")
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(cmd.VisitWebPage(false, u), gc.IsNil)
+	c.Assert(logged.String(), gc.Matches, `(?s).*to authorize a discharge, visit http://discharger.example.com/visit\?waitid=1\n`)
+	c.Assert(cmd.VisitWebPage(true, u), gc.ErrorMatches, `interaction required at http://discharger.example.com/visit\?waitid=1`)
+}
+
+func (s *cmdSuite) TestNonInteractiveDischarge(c *gc.C) {
+	// A discharger which always requires interaction.
+	var waited int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/discharge":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, `{"Code":"interaction required","Message":"log in","Info":{"VisitURL":%q,"WaitURL":%q}}`,
+				srv.URL+"/visit", srv.URL+"/wait")
+		case "/wait":
+			atomic.AddInt32(&waited, 1)
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+	auth := s.newCaveatedAuth(c, "hello world", srv.URL,
+		"bHzL5Q38Fb3u4tXe4nWY4Dod0pDH+mOT8a1CzLVxbzE=", "is-logged-in")
+
+	err := cmd.NewFetchCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":             s.server.URL,
+			"home":            s.home,
+			"non-interactive": true,
+		},
+		stdin: bytes.NewBuffer(auth),
+	})
+	c.Assert(err, gc.ErrorMatches, `.*interaction required at `+srv.URL+`/visit.*`)
+	c.Assert(atomic.LoadInt32(&waited), gc.Equals, int32(0))
+}
+
+func (s *cmdSuite) TestDischargeOffline(c *gc.C) {
+	// The signer's key is only needed to add the caveat; its server is
+	// never asked for a discharge.
+	signHome := c.MkDir()
+	signFlags := map[string]interface{}{
+		"home":    signHome,
+		"checker": "allow",
+		"allow":   "is-audited",
+	}
+	srv, key, requests := s.startDischarger(c, signFlags)
+	srv.Close()
+	auth := s.newCaveatedAuth(c, "hello world", srv.URL, key, "is-audited")
+
+	var reqs bytes.Buffer
+	c.Assert(cmd.NewDischargeCommand().Do(&StubContext{
+		args:  []string{"export"},
+		stdin: bytes.NewBuffer(auth), stdout: &reqs,
+	}), gc.IsNil)
+	var exported []struct {
+		Location string
+		Id       string
+	}
+	c.Assert(json.Unmarshal(reqs.Bytes(), &exported), gc.IsNil)
+	// client:encrypt caveats are not exported.
+	c.Assert(exported, gc.HasLen, 1)
+	c.Assert(exported[0].Location, gc.Equals, srv.URL)
+
+	// Conditions are checked when signing.
+	var discharges bytes.Buffer
+	c.Assert(cmd.NewDischargeCommand().Do(&StubContext{
+		args:  []string{"sign"},
+		flags: map[string]interface{}{"home": signHome, "checker": "allow", "allow": "is-secret"},
+		stdin: bytes.NewBuffer(reqs.Bytes()), stdout: &discharges,
+	}), gc.ErrorMatches, `1 of 1 caveats not discharged`)
+	c.Assert(discharges.Len(), gc.Equals, 0)
+	c.Assert(cmd.NewDischargeCommand().Do(&StubContext{
+		args:  []string{"sign"},
+		flags: signFlags,
+		stdin: bytes.NewBuffer(reqs.Bytes()), stdout: &discharges,
+	}), gc.IsNil)
+	dischargesFile := filepath.Join(c.MkDir(), "discharges.json")
+	c.Assert(ioutil.WriteFile(dischargesFile, discharges.Bytes(), 0600), gc.IsNil)
+
+	var bound, out bytes.Buffer
+	c.Assert(cmd.NewDischargeCommand().Do(&StubContext{
+		args:  []string{"import"},
+		flags: map[string]interface{}{"discharges": dischargesFile},
+		stdin: bytes.NewBuffer(auth), stdout: &bound,
+	}), gc.IsNil)
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: map[string]interface{}{"url": s.server.URL, "home": s.home},
+		stdin: bytes.NewBuffer(bound.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "hello world")
+	c.Assert(atomic.LoadInt32(requests), gc.Equals, int32(0))
+
+	// Nothing is left to export from the bound auth.
+	c.Assert(cmd.NewDischargeCommand().Do(&StubContext{
+		args:  []string{"export"},
+		stdin: bytes.NewBuffer(bound.Bytes()),
+	}), gc.ErrorMatches, `no third-party caveats to discharge`)
+	// Discharges can't be imported into an auth for another object.
+	other := s.newCaveatedAuth(c, "goodbye", srv.URL, key, "is-audited")
+	c.Assert(cmd.NewDischargeCommand().Do(&StubContext{
+		args:  []string{"import"},
+		flags: map[string]interface{}{"discharges": dischargesFile},
+		stdin: bytes.NewBuffer(other),
+	}), gc.ErrorMatches, `discharge .* does not match any caveat in auth`)
+}
+
+func (s *cmdSuite) TestDischargeCheckers(c *gc.C) {
+	req, err := http.NewRequest("POST", "http://example.com/discharge", nil)
+	c.Assert(err, gc.IsNil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	check := func(flags map[string]interface{}, condition string) ([]string, error) {
+		return cmd.CheckDischarge(&StubContext{flags: flags}, req, condition)
+	}
+
+	allow := map[string]interface{}{"checker": "allow", "allow": "is-audited, is-timestamped"}
+	conds, err := check(allow, "is-audited")
+	c.Assert(err, gc.IsNil)
+	c.Assert(conds, gc.HasLen, 0)
+	_, err = check(allow, "is-secret")
+	c.Assert(err, gc.ErrorMatches, `condition not allowed`)
+
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	_, err = check(map[string]interface{}{"checker": "time", "not-before": future}, "is-audited")
+	c.Assert(err, gc.ErrorMatches, `not before .*`)
+	window := map[string]interface{}{"checker": "time", "not-after": future}
+	conds, err = check(window, "is-audited")
+	c.Assert(err, gc.IsNil)
+	c.Assert(conds, gc.DeepEquals, []string{"time-before " + future})
+
+	// The exec checker gets the condition on stdin, never in its arguments.
+	script := filepath.Join(c.MkDir(), "check.sh")
+	c.Assert(ioutil.WriteFile(script, []byte(`#!/bin/sh
+[ $# -eq 0 ] || exit 2
+[ "$(cat)" = "is-audited" ] || exit 1
+echo "operation fetch"
+`), 0700), gc.IsNil)
+	execFlags := map[string]interface{}{"checker": "exec", "exec": script}
+	conds, err = check(execFlags, "is-audited")
+	c.Assert(err, gc.IsNil)
+	c.Assert(conds, gc.DeepEquals, []string{"operation fetch"})
+	_, err = check(execFlags, "is-secret")
+	c.Assert(err, gc.ErrorMatches, `exit status 1`)
+
+	// client:encrypt conditions are refused, even by checkers which would
+	// discharge anything.
+	envelope := `{"Nonce":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA","Key":"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`
+	for _, flags := range []map[string]interface{}{window, execFlags} {
+		_, err = check(flags, envelope)
+		c.Assert(err, gc.ErrorMatches, `client:encrypt caveats are not discharged by this service`)
+	}
+}
+
+func (s *cmdSuite) TestDischargeServer(c *gc.C) {
+	var handler http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	// The discharge server shares the client's key, so it could open the
+	// client's client:encrypt caveats.
+	var err error
+	handler, err = cmd.NewDischargeHandler(&StubContext{
+		flags: map[string]interface{}{
+			"home":     s.home,
+			"location": srv.URL,
+			"checker":  "allow",
+			"allow":    "is-audited",
+		},
+	})
+	c.Assert(err, gc.IsNil)
+	resp, err := http.Get(srv.URL + "/publickey")
+	c.Assert(err, gc.IsNil)
+	var pk struct {
+		PublicKey string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&pk)
+	resp.Body.Close()
+	c.Assert(err, gc.IsNil)
+
+	flags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": s.home,
+	}
+	var auth, caveated, out bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBufferString("hello world"), stdout: &auth,
+	}), gc.IsNil)
+	c.Assert(cmd.NewCondCommand().Do(&StubContext{
+		args: []string{"is-audited"},
+		flags: map[string]interface{}{
+			"url":      s.server.URL,
+			"location": srv.URL,
+			"key":      pk.PublicKey,
+		},
+		stdin: bytes.NewBuffer(auth.Bytes()), stdout: &caveated,
+	}), gc.IsNil)
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(caveated.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "hello world")
+
+	// Posting the client:encrypt caveat to the server does not reveal the
+	// envelope.
+	var ms macaroon.Slice
+	c.Assert(json.Unmarshal(auth.Bytes(), &ms), gc.IsNil)
+	var cavId string
+	for _, cav := range ms[0].Caveats() {
+		if cav.Location == "client:encrypt" {
+			cavId = cav.Id
+		}
+	}
+	c.Assert(cavId, gc.Not(gc.Equals), "")
+	resp, err = http.PostForm(srv.URL+"/discharge", url.Values{"id": {cavId}})
+	c.Assert(err, gc.IsNil)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.StatusCode, gc.Not(gc.Equals), http.StatusOK)
+	c.Assert(string(body), gc.Matches, `(?s).*client:encrypt caveats are not discharged by this service.*`)
+	c.Assert(string(body), gc.Not(gc.Matches), `(?s).*(Nonce|Key|SHA384).*`)
+}
+
+func (s *cmdSuite) TestApprovals(c *gc.C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.home, "approve-token"), []byte("sekrit"), 0600), gc.IsNil)
+	q := cmd.NewApprovalQueue(time.Minute, time.Minute)
+	srv := httptest.NewServer(q.Handler("sekrit"))
+	defer srv.Close()
+	approvals := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := cmd.NewApprovalsCommand().Do(&StubContext{
+			args:   args,
+			flags:  map[string]interface{}{"home": s.home, "url": srv.URL},
+			stdout: &out,
+		})
+		return out.String(), err
+	}
+	// check starts a request and waits for it to be listed.
+	var granted []string
+	check := func(condition string) (<-chan error, string) {
+		result := make(chan error, 1)
+		go func() {
+			var err error
+			granted, err = q.Check(condition)
+			result <- err
+		}()
+		for i := 0; i < 100; i++ {
+			out, err := approvals("list")
+			c.Assert(err, gc.IsNil)
+			if out != "" {
+				return result, out
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Fatalf("request for %q not listed", condition)
+		return nil, ""
+	}
+
+	result, out := check("approved-by ops ticket-1234")
+	// Only the name of the condition is listed, not its arguments.
+	c.Assert(out, gc.Matches, "1\t.*\t127.0.0.1:1234\tapproved-by [0-9a-f]{12}\n")
+	c.Assert(out, gc.Not(gc.Matches), `(?s).*ticket-1234.*`)
+	_, err := approvals("grant", "1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(<-result, gc.IsNil)
+	// The discharge for a grant expires.
+	c.Assert(granted, gc.HasLen, 1)
+	c.Assert(granted[0], gc.Matches, `time-before .*`)
+	expires, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(granted[0], "time-before "))
+	c.Assert(err, gc.IsNil)
+	c.Assert(expires.After(time.Now()), gc.Equals, true)
+	c.Assert(expires.Before(time.Now().Add(time.Minute)), gc.Equals, true)
+
+	result, _ = check("approved-by ops")
+	_, err = approvals("deny", "2")
+	c.Assert(err, gc.IsNil)
+	c.Assert(<-result, gc.ErrorMatches, `denied`)
+
+	// Decided requests can't be decided again, and unknown ones aren't found.
+	_, err = approvals("deny", "1")
+	c.Assert(err, gc.ErrorMatches, `409 Conflict: approval 1 no longer pending.*`)
+	_, err = approvals("grant", "3")
+	c.Assert(err, gc.ErrorMatches, `404 Not Found: approval 3 not found`)
+
+	_, err = approvals("grant", "1", "2")
+	c.Assert(err, gc.ErrorMatches, `invalid approvals command "grant 1 2"`)
+}
+
+func (s *cmdSuite) TestApprovalTimeout(c *gc.C) {
+	c.Assert(ioutil.WriteFile(filepath.Join(s.home, "approve-token"), []byte("sekrit"), 0600), gc.IsNil)
+	q := cmd.NewApprovalQueue(10*time.Millisecond, time.Minute)
+	srv := httptest.NewServer(q.Handler("sekrit"))
+	defer srv.Close()
+	_, err := q.Check("approved-by ops")
+	c.Assert(err, gc.ErrorMatches, `timed out waiting for approval`)
+	// A decision after the timeout is reported to the approver.
+	err = cmd.NewApprovalsCommand().Do(&StubContext{
+		args:  []string{"grant", "1"},
+		flags: map[string]interface{}{"home": s.home, "url": srv.URL},
+	})
+	c.Assert(err, gc.ErrorMatches, `409 Conflict: approval 1 no longer pending: already decided or timed out`)
+
+	// The wrong token is refused.
+	c.Assert(ioutil.WriteFile(filepath.Join(s.home, "approve-token"), []byte("guess"), 0600), gc.IsNil)
+	err = cmd.NewApprovalsCommand().Do(&StubContext{
+		args:  []string{"list"},
+		flags: map[string]interface{}{"home": s.home, "url": srv.URL},
+	})
+	c.Assert(err, gc.ErrorMatches, `401 Unauthorized: invalid token`)
+}
+
+func (s *cmdSuite) TestHOTPVectors(c *gc.C) {
+	// RFC 4226, Appendix D.
+	secret := []byte("12345678901234567890")
+	for counter, code := range []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	} {
+		c.Check(cmd.HOTPCode(secret, uint64(counter)), gc.Equals, code)
+	}
+}
+
+func (s *cmdSuite) TestTOTPVectors(c *gc.C) {
+	// RFC 6238, Appendix B, SHA1, truncated to 6 digits.
+	secret := []byte("12345678901234567890")
+	for _, t := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		c.Check(cmd.TOTPCode(secret, time.Unix(t.unix, 0)), gc.Equals, t.code)
+	}
+}
+
+func (s *cmdSuite) TestTOTPReplay(c *gc.C) {
+	var uri bytes.Buffer
+	c.Assert(cmd.NewTOTPEnrollCommand().Do(&StubContext{
+		args:   []string{"prod"},
+		flags:  map[string]interface{}{"home": s.home},
+		stdout: &uri,
+	}), gc.IsNil)
+	u, err := url.Parse(strings.TrimSpace(uri.String()))
+	c.Assert(err, gc.IsNil)
+	secret, err := base32.StdEncoding.DecodeString(u.Query().Get("secret"))
+	c.Assert(err, gc.IsNil)
+
+	check, err := cmd.NewDischargeChecker(&StubContext{
+		flags: map[string]interface{}{"home": s.home, "checker": "totp"},
+	})
+	c.Assert(err, gc.IsNil)
+	discharge := func(code string) error {
+		req, err := http.NewRequest("POST", "http://127.0.0.1:8080/totp/discharge",
+			strings.NewReader(url.Values{"totp": {code}}.Encode()))
+		c.Assert(err, gc.IsNil)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		_, err = check(req, "totp prod")
+		return err
+	}
+	code := cmd.TOTPCode(secret, time.Now())
+	c.Assert(discharge(code), gc.IsNil)
+	c.Assert(discharge(code), gc.ErrorMatches, `TOTP code already used`)
+	c.Assert(discharge(""), gc.ErrorMatches, `TOTP code required`)
+	c.Assert(discharge(cmd.TOTPCode(secret, time.Now().Add(-time.Hour))), gc.ErrorMatches, `invalid TOTP code`)
+}
+
+func (s *cmdSuite) TestTOTPDischargeExpires(c *gc.C) {
+	defer os.Setenv("OO_TOTP", os.Getenv("OO_TOTP"))
+	defer os.Setenv("OO_TOTP_LOCATIONS", os.Getenv("OO_TOTP_LOCATIONS"))
+
+	totpHome := c.MkDir()
+	var uri bytes.Buffer
+	c.Assert(cmd.NewTOTPEnrollCommand().Do(&StubContext{
+		args:   []string{"prod"},
+		flags:  map[string]interface{}{"home": totpHome},
+		stdout: &uri,
+	}), gc.IsNil)
+	u, err := url.Parse(strings.TrimSpace(uri.String()))
+	c.Assert(err, gc.IsNil)
+	secret, err := base32.StdEncoding.DecodeString(u.Query().Get("secret"))
+	c.Assert(err, gc.IsNil)
+
+	var handler http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handler.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+	location := srv.URL + "/totp"
+	handler, err = cmd.NewDischargeHandler(&StubContext{flags: map[string]interface{}{
+		"home":     totpHome,
+		"checker":  "totp",
+		"location": location,
+		"totp-ttl": "1s",
+	}})
+	c.Assert(err, gc.IsNil)
+	resp, err := http.Get(location + "/publickey")
+	c.Assert(err, gc.IsNil)
+	var pk struct {
+		PublicKey string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&pk)
+	resp.Body.Close()
+	c.Assert(err, gc.IsNil)
+
+	var auth, totpAuth, bound bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{"url": s.server.URL, "home": s.home},
+		stdin: bytes.NewBufferString("hunter2"), stdout: &auth,
+	}), gc.IsNil)
+	c.Assert(cmd.NewCondCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":      s.server.URL,
+			"totp":     "prod",
+			"location": location,
+			"key":      pk.PublicKey,
+		},
+		stdin: bytes.NewBuffer(auth.Bytes()), stdout: &totpAuth,
+	}), gc.IsNil)
+
+	os.Setenv("OO_TOTP_LOCATIONS", location)
+	os.Setenv("OO_TOTP", cmd.TOTPCode(secret, time.Now()))
+	flags := map[string]interface{}{
+		"url":                s.server.URL,
+		"home":               s.home,
+		"non-interactive":    true,
+		"no-discharge-cache": true,
+	}
+	c.Assert(cmd.NewDischargeCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(totpAuth.Bytes()), stdout: &bound,
+	}), gc.IsNil)
+	fetch := func() (string, error) {
+		var out bytes.Buffer
+		err := cmd.NewFetchCommand().Do(&StubContext{
+			flags: flags,
+			stdin: bytes.NewBuffer(bound.Bytes()), stdout: &out,
+		})
+		return out.String(), err
+	}
+	out, err := fetch()
+	c.Assert(err, gc.IsNil)
+	c.Assert(out, gc.Equals, "hunter2")
+	// Once the TOTP discharge expires, the bound auth no longer works.
+	time.Sleep(1500 * time.Millisecond)
+	out, err = fetch()
+	c.Assert(err, gc.NotNil)
+	c.Assert(out, gc.Equals, "")
+}
+
+func (s *cmdSuite) TestTOTPLocationNotConfigured(c *gc.C) {
+	defer os.Setenv("OO_TOTP", os.Getenv("OO_TOTP"))
+	defer os.Setenv("OO_TOTP_LOCATIONS", os.Getenv("OO_TOTP_LOCATIONS"))
+	os.Setenv("OO_TOTP", "123456")
+	os.Setenv("OO_TOTP_LOCATIONS", "")
+
+	var auth, totpAuth bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{"url": s.server.URL, "home": s.home},
+		stdin: bytes.NewBufferString("hunter2"), stdout: &auth,
+	}), gc.IsNil)
+	// Nothing listens here; the code must not be sent anyway.
+	location := "http://127.0.0.1:1/totp"
+	c.Assert(cmd.NewCondCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":      s.server.URL,
+			"totp":     "prod",
+			"location": location,
+			"key":      "bHzL5Q38Fb3u4tXe4nWY4Dod0pDH+mOT8a1CzLVxbzE=",
+		},
+		stdin: bytes.NewBuffer(auth.Bytes()), stdout: &totpAuth,
+	}), gc.IsNil)
+	fetch := func() error {
+		return cmd.NewFetchCommand().Do(&StubContext{
+			flags: map[string]interface{}{
+				"url":             s.server.URL,
+				"home":            s.home,
+				"non-interactive": true,
+			},
+			stdin: bytes.NewBuffer(totpAuth.Bytes()),
+		})
+	}
+	c.Assert(fetch(), gc.ErrorMatches, `.*TOTP location "http://127.0.0.1:1/totp" is not in \$OO_TOTP_LOCATIONS.*`)
+	os.Setenv("OO_TOTP_LOCATIONS", "http://example.com/totp, "+location+"/")
+	c.Assert(fetch(), gc.ErrorMatches, `.*error requesting "http://127.0.0.1:1/totp/discharge".*`)
+}
+
+func (s *cmdSuite) TestSecureBufferGrow(c *gc.C) {
+	sb := cmd.NewSecureBuffer(0)
+	defer sb.Destroy()
+	_, err := sb.Write([]byte("hello"))
+	c.Assert(err, gc.IsNil)
+	capacity := sb.Cap()
+	c.Assert(capacity >= 5, gc.Equals, true)
+	sb.Grow(capacity)
+	c.Assert(sb.Cap() >= capacity+5, gc.Equals, true)
+	c.Assert(string(sb.Bytes()), gc.Equals, "hello")
+
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+	_, err = sb.Write(big)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sb.Len(), gc.Equals, 5+len(big))
+	c.Assert(bytes.Equal(sb.Bytes()[5:], big), gc.Equals, true)
+
+	read, err := cmd.ReadSecure(bytes.NewReader(big))
+	c.Assert(err, gc.IsNil)
+	defer read.Destroy()
+	c.Assert(bytes.Equal(read.Bytes(), big), gc.Equals, true)
+}
+
+func (s *cmdSuite) TestSecureBufferTruncate(c *gc.C) {
+	sb := cmd.NewSecureBuffer(0)
+	defer sb.Destroy()
+	sb.Write([]byte("hello world"))
+	sb.Truncate(5)
+	c.Assert(string(sb.Bytes()), gc.Equals, "hello")
+	// The discarded contents are zeroed.
+	c.Assert(sb.Bytes()[:11][5:], gc.DeepEquals, make([]byte, 6))
+	sb.Write([]byte("!"))
+	c.Assert(string(sb.Bytes()), gc.Equals, "hello!")
+}
+
+func (s *cmdSuite) TestSecureBufferReadDestroys(c *gc.C) {
+	sb := cmd.NewSecureBuffer(0)
+	sb.Write([]byte("secret"))
+	contents, err := ioutil.ReadAll(sb)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(contents), gc.Equals, "secret")
+	c.Assert(sb.Destroyed(), gc.Equals, true)
+	c.Assert(sb.Len(), gc.Equals, 0)
+	n, err := sb.Read(make([]byte, 1))
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(err, gc.Equals, io.EOF)
+}
+
+func (s *cmdSuite) TestSecureBufferDoubleDestroy(c *gc.C) {
+	sb := cmd.NewSecureBuffer(32)
+	c.Assert(sb.Len(), gc.Equals, 32)
+	sb.Destroy()
+	c.Assert(sb.Destroyed(), gc.Equals, true)
+	sb.Destroy()
+	c.Assert(sb.Destroyed(), gc.Equals, true)
+	c.Assert(sb.Bytes(), gc.HasLen, 0)
+}
+
+func (s *cmdSuite) TestShare(c *gc.C) {
+	bobHome := c.MkDir()
+	var bobKey bytes.Buffer
+	c.Assert(cmd.NewKeyCommand().Do(&StubContext{
+		flags:  map[string]interface{}{"home": bobHome},
+		stdout: &bobKey,
+	}), gc.IsNil)
+	c.Assert(os.MkdirAll(filepath.Join(s.home, "contacts"), 0700), gc.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(s.home, "contacts", "bob"), bobKey.Bytes(), 0600), gc.IsNil)
+
+	in := bytes.NewBufferString("hello bob")
+	var auth, bobAuth, out bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": s.home,
+		},
+		stdin: in, stdout: &auth,
+	}), gc.IsNil)
+	c.Assert(cmd.NewShareCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"home":    s.home,
+			"to":      "bob",
+			"expires": "7d",
+			"op":      "fetch",
+		},
+		stdin: bytes.NewBuffer(auth.Bytes()), stdout: &bobAuth,
+	}), gc.IsNil)
+	bobFlags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": bobHome,
+	}
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: bobFlags,
+		stdin: bytes.NewBuffer(bobAuth.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "hello bob")
+	c.Assert(cmd.NewDeleteCommand().Do(&StubContext{
+		flags: bobFlags,
+		stdin: bytes.NewBuffer(bobAuth.Bytes()),
+	}), gc.ErrorMatches, `.*operation "delete" not allowed.*`)
+}
+
+func (s *cmdSuite) TestNewInvalidRecipient(c *gc.C) {
+	// Valid base58, but too short to be a public key.
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": s.home,
+			"to":   "abc",
+		},
+		stdin: bytes.NewBufferString("hello world"),
+	}), gc.ErrorMatches, `invalid recipient "abc": not a contact or public key`)
+}
+
+func (s *cmdSuite) TestEscrowRecover(c *gc.C) {
+	escrowHome, newHome := c.MkDir(), c.MkDir()
+	var escrowKey, newKey bytes.Buffer
+	c.Assert(cmd.NewKeyCommand().Do(&StubContext{
+		flags:  map[string]interface{}{"home": escrowHome},
+		stdout: &escrowKey,
+	}), gc.IsNil)
+	c.Assert(cmd.NewKeyCommand().Do(&StubContext{
+		flags:  map[string]interface{}{"home": newHome},
+		stdout: &newKey,
+	}), gc.IsNil)
+
+	escrowFile := filepath.Join(c.MkDir(), "escrow.auth")
+	in := bytes.NewBufferString("lost and found")
+	var auth, recovered, out bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":           s.server.URL,
+			"home":          s.home,
+			"escrow":        strings.TrimSpace(escrowKey.String()),
+			"escrow-output": escrowFile,
+		},
+		stdin: in, stdout: &auth,
+	}), gc.IsNil)
+	c.Assert(cmd.NewRecoverCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"home":  escrowHome,
+			"input": escrowFile,
+			"to":    strings.TrimSpace(newKey.String()),
+		},
+		stdout: &recovered,
+	}), gc.IsNil)
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": newHome,
+		},
+		stdin: bytes.NewBuffer(recovered.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "lost and found")
+}
+
+func (s *cmdSuite) TestNewOutput(c *gc.C) {
+	dir := c.MkDir()
+	authFile := filepath.Join(dir, "hello.auth")
+	flags := map[string]interface{}{
+		"url":    s.server.URL,
+		"home":   s.home,
+		"output": authFile,
+	}
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBufferString("hello world"),
+	}), gc.IsNil)
+	fi, err := os.Stat(authFile)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fi.Mode().Perm(), gc.Equals, os.FileMode(0600))
+
+	// A failed upload leaves no output file behind.
+	failedFile := filepath.Join(dir, "failed.auth")
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":    "http://127.0.0.1:1",
+			"home":   s.home,
+			"output": failedFile,
+		},
+		stdin: bytes.NewBufferString("hello world"),
+	}), gc.NotNil)
+	_, err = os.Stat(failedFile)
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+
+	caveatedFile := filepath.Join(dir, "caveated.auth")
+	c.Assert(cmd.NewCondCommand().Do(&StubContext{
+		args: []string{"time-before 2030-01-01T00:00:00Z"},
+		flags: map[string]interface{}{
+			"url":    s.server.URL,
+			"input":  authFile,
+			"output": caveatedFile,
+		},
+	}), gc.IsNil)
+	fi, err = os.Stat(caveatedFile)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fi.Mode().Perm(), gc.Equals, os.FileMode(0600))
+}
+
+func (s *cmdSuite) TestEscrowOutputFails(c *gc.C) {
+	service, err := oostore.NewService(oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+	})
+	c.Assert(err, gc.IsNil)
+	var created, deleted int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			atomic.AddInt32(&created, 1)
+		case "DELETE":
+			atomic.AddInt32(&deleted, 1)
+		}
+		service.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	var key, auth bytes.Buffer
+	c.Assert(cmd.NewKeyCommand().Do(&StubContext{
+		flags:  map[string]interface{}{"home": c.MkDir()},
+		stdout: &key,
+	}), gc.IsNil)
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":           srv.URL,
+			"home":          s.home,
+			"escrow":        strings.TrimSpace(key.String()),
+			"escrow-output": filepath.Join(c.MkDir(), "missing", "escrow.auth"),
+		},
+		stdin: bytes.NewBufferString("hello world"), stdout: &auth,
+	}), gc.ErrorMatches, `failed to write escrow auth: .*`)
+	// the object is deleted rather than left without an auth
+	c.Assert(auth.Len(), gc.Equals, 0)
+	c.Assert(atomic.LoadInt32(&created), gc.Equals, int32(1))
+	c.Assert(atomic.LoadInt32(&deleted), gc.Equals, int32(1))
+}
+
+func (s *cmdSuite) TestSplitCombine(c *gc.C) {
+	var key bytes.Buffer
+	c.Assert(cmd.NewKeyCommand().Do(&StubContext{
+		flags:  map[string]interface{}{"home": s.home},
+		stdout: &key,
+	}), gc.IsNil)
+	me := strings.TrimSpace(key.String())
+	dir := c.MkDir()
+	flags := map[string]interface{}{
+		"url":    s.server.URL,
+		"home":   s.home,
+		"split":  "2-of-3",
+		"to":     strings.Join([]string{me, me, me}, ","),
+		"output": dir,
+	}
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBufferString("root password"),
+	}), gc.IsNil)
+
+	share := func(n int) string { return filepath.Join(dir, fmt.Sprintf("share-%d.auth", n)) }
+	for n := 1; n <= 3; n++ {
+		fi, err := os.Stat(share(n))
+		c.Assert(err, gc.IsNil)
+		c.Assert(fi.Mode().Perm(), gc.Equals, os.FileMode(0600))
+	}
+	combineFlags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": s.home,
+	}
+	var out bytes.Buffer
+	c.Assert(cmd.NewCombineCommand().Do(&StubContext{
+		flags:  combineFlags,
+		args:   []string{share(3), share(1)},
+		stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "root password")
+	c.Assert(cmd.NewCombineCommand().Do(&StubContext{
+		flags: combineFlags,
+		args:  []string{share(2)},
+	}), gc.ErrorMatches, `need 2 shares, got 1`)
+
+	// Shares record a MAC under a random key, not a digest of the secret,
+	// so splitting the same secret again gives unrelated shares.
+	otherDir := c.MkDir()
+	flags["output"] = otherDir
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBufferString("root password"),
+	}), gc.IsNil)
+	c.Assert(cmd.NewCombineCommand().Do(&StubContext{
+		flags: combineFlags,
+		args:  []string{share(1), filepath.Join(otherDir, "share-2.auth")},
+	}), gc.ErrorMatches, `share 2 is from a different secret`)
+}
+
+func (s *cmdSuite) TestAuthFormats(c *gc.C) {
+	for _, version := range []string{"1", "2"} {
+		for _, format := range []string{"json", "b64", "armor", "binary"} {
+			c.Logf("format %s, version %s", format, version)
+			var auth, out bytes.Buffer
+			c.Assert(cmd.NewNewCommand().Do(&StubContext{
+				flags: map[string]interface{}{
+					"url":              s.server.URL,
+					"home":             s.home,
+					"auth-format":      format,
+					"macaroon-version": version,
+				},
+				stdin: bytes.NewBufferString("hello " + format), stdout: &auth,
+			}), gc.IsNil)
+			if format == "b64" {
+				c.Assert(strings.Count(auth.String(), "\n"), gc.Equals, 1)
+			}
+			c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+				flags: map[string]interface{}{
+					"url":  s.server.URL,
+					"home": s.home,
+				},
+				stdin: bytes.NewBuffer(auth.Bytes()), stdout: &out,
+			}), gc.IsNil)
+			c.Assert(out.String(), gc.Equals, "hello "+format)
+		}
+	}
+}
+
+// These vectors were produced by the reference implementation,
+// gopkg.in/macaroon.v2: a primary macaroon under the root key "root key" with
+// a first-party caveat and a third-party caveat, followed by its bound
+// discharge.
+const (
+	macaroonV2BinaryVector = "AgEbaHR0cDovL29vc3RvcmUuZXhhbXBsZS5jb20vAgtvYmplY3QtMTIzNAACIHRpbWUtYmVmb3JlIDIwMzAtMDEtMDFUMDA6MDA6MDBaAAEdaHR0cDovL2Rpc2NoYXJnZS5leGFtcGxlLmNvbS8CCmlzLWF1ZGl0ZWQESPRqOmP9fNtM3Bky9HaZly/eWaynZgOu5vc7gcC//Y1m2lnSZKg3A+FO7+/FgCongn7L8Jo3Dg3gHn7gJMRhdSGRa/xQn3XxNQAABiBdnVzefJYhxo+MaRLgM9FetEyqLPf//8cbGxNkTkB7lgIBHWh0dHA6Ly9kaXNjaGFyZ2UuZXhhbXBsZS5jb20vAgppcy1hdWRpdGVkAAAGIH5B7qWYSyNV7U7th/6wFWAtIM6s+KxTvtErVIuDaw8E"
+	macaroonV2JSONVector   = `[{"c":[{"i":"time-before 2030-01-01T00:00:00Z"},{"i":"is-audited","v64":"9Go6Y_1820zcGTL0dpmXL95ZrKdmA67m9zuBwL_9jWbaWdJkqDcD4U7v78WAKieCfsvwmjcODeAefuAkxGF1IZFr_FCfdfE1","l":"http://discharge.example.com/"}],"l":"http://oostore.example.com/","i":"object-1234","s64":"XZ1c3nyWIcaPjGkS4DPRXrRMqiz3___HGxsTZE5Ae5Y"},{"l":"http://discharge.example.com/","i":"is-audited","s64":"fkHupZhLI1XtTu2H_rAVYC0gzqz4rFO-0StUi4NrDwQ"}]`
+)
+
+func (s *cmdSuite) TestMacaroonV2Vectors(c *gc.C) {
+	bin, err := base64.StdEncoding.DecodeString(macaroonV2BinaryVector)
+	c.Assert(err, gc.IsNil)
+	for _, vector := range [][]byte{bin, []byte(macaroonV2JSONVector)} {
+		ms, err := cmd.UnmarshalAuth(vector)
+		c.Assert(err, gc.IsNil)
+		c.Assert(ms, gc.HasLen, 2)
+		c.Assert(ms[0].Location(), gc.Equals, "http://oostore.example.com/")
+		c.Assert(ms[0].Id(), gc.Equals, "object-1234")
+		c.Assert(ms[0].Caveats(), gc.DeepEquals, []macaroon.Caveat{
+			{Id: "time-before 2030-01-01T00:00:00Z"},
+			{Id: "is-audited", Location: "http://discharge.example.com/"},
+		})
+		c.Assert(fmt.Sprintf("%x", ms[0].Signature()), gc.Equals,
+			"5d9d5cde7c9621c68f8c6912e033d15eb44caa2cf7ffffc71b1b13644e407b96")
+		c.Assert(ms[1].Location(), gc.Equals, "http://discharge.example.com/")
+		c.Assert(ms[1].Id(), gc.Equals, "is-audited")
+		c.Assert(ms[1].Caveats(), gc.HasLen, 0)
+		c.Assert(fmt.Sprintf("%x", ms[1].Signature()), gc.Equals,
+			"7e41eea5984b2355ed4eed87feb015602d20ceacf8ac53bed12b548b836b0f04")
+		// The signatures, and the third-party caveat's verification id,
+		// survive the conversion.
+		c.Assert(ms[0].Verify([]byte("root key"), func(string) error { return nil }, ms[1:]), gc.IsNil)
+
+		// Encoding gives the reference implementation's output exactly.
+		out, err := cmd.MarshalBinaryV2(ms)
+		c.Assert(err, gc.IsNil)
+		c.Assert(out, gc.DeepEquals, bin)
+		out, err = cmd.MarshalJSONV2(ms)
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(out), gc.Equals, macaroonV2JSONVector)
+	}
+
+	// The example from the version 2 format specification, in base64.
+	ms, err := cmd.UnmarshalAuth([]byte("AgETaHR0cDovL2V4YW1wbGUub3JnLwIFa2V5aWQAAhRhY2NvdW50ID0gMzczNTkyODU1OQACDHVzZXIgPSBhbGljZQAABiBL6WfNHqDGsmuvakqU7psFsViG2guoXoxCqTyNDhJe_A=="))
+	c.Assert(err, gc.IsNil)
+	c.Assert(ms, gc.HasLen, 1)
+	c.Assert(ms[0].Location(), gc.Equals, "http://example.org/")
+	c.Assert(ms[0].Id(), gc.Equals, "keyid")
+	c.Assert(ms[0].Caveats(), gc.DeepEquals, []macaroon.Caveat{
+		{Id: "account = 3735928559"},
+		{Id: "user = alice"},
+	})
+	c.Assert(fmt.Sprintf("%x", ms[0].Signature()), gc.Equals,
+		"4be967cd1ea0c6b26baf6a4a94ee9b05b15886da0ba85e8c42a93c8d0e125efc")
+}
+
+func (s *cmdSuite) TestCopy(c *gc.C) {
+	service, err := oostore.NewService(oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+	})
+	c.Assert(err, gc.IsNil)
+	dest := httptest.NewServer(service)
+	defer dest.Close()
+
+	for _, reencrypt := range []bool{false, true} {
+		in := bytes.NewBufferString("hello world")
+		var oldAuth, newAuth, out bytes.Buffer
+		c.Assert(cmd.NewNewCommand().Do(&StubContext{
+			flags: map[string]interface{}{
+				"url":  s.server.URL,
+				"home": s.home,
+			},
+			stdin: in, stdout: &oldAuth,
+		}), gc.IsNil)
+		c.Assert(cmd.NewCopyCommand().Do(&StubContext{
+			flags: map[string]interface{}{
+				"url":       s.server.URL,
+				"to-url":    dest.URL,
+				"home":      s.home,
+				"reencrypt": reencrypt,
+				"delete":    true,
+			},
+			stdin: bytes.NewBuffer(oldAuth.Bytes()), stdout: &newAuth,
+		}), gc.IsNil)
+		c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+			flags: map[string]interface{}{
+				"url":  dest.URL,
+				"home": s.home,
+			},
+			stdin: bytes.NewBuffer(newAuth.Bytes()), stdout: &out,
+		}), gc.IsNil)
+		c.Assert(out.String(), gc.Equals, "hello world")
+		c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+			flags: map[string]interface{}{
+				"url":  s.server.URL,
+				"home": s.home,
+			},
+			stdin: bytes.NewBuffer(oldAuth.Bytes()),
+		}), gc.ErrorMatches, `^404 Not Found.*`)
+	}
+}
+
+func (s *cmdSuite) TestCopyOutputFails(c *gc.C) {
+	service, err := oostore.NewService(oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+	})
+	c.Assert(err, gc.IsNil)
+	var deleted int32
+	dest := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "DELETE" {
+			atomic.AddInt32(&deleted, 1)
+		}
+		service.ServeHTTP(w, req)
+	}))
+	defer dest.Close()
+
+	var auth, out bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": s.home,
+		},
+		stdin: bytes.NewBufferString("hello world"), stdout: &auth,
+	}), gc.IsNil)
+	outputFile := filepath.Join(c.MkDir(), "missing", "copy.auth")
+	c.Assert(cmd.NewCopyCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":    s.server.URL,
+			"to-url": dest.URL,
+			"home":   s.home,
+			"delete": true,
+			"output": outputFile,
+		},
+		stdin: bytes.NewBuffer(auth.Bytes()),
+	}), gc.ErrorMatches, `copy failed: cannot write .*`)
+	// the copy is deleted, and the original kept
+	c.Assert(atomic.LoadInt32(&deleted), gc.Equals, int32(1))
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": s.home,
+		},
+		stdin: bytes.NewBuffer(auth.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "hello world")
+}
+
+func (s *cmdSuite) TestCopyNotAddressed(c *gc.C) {
+	var auth bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": s.home,
+		},
+		stdin: bytes.NewBufferString("hello world"), stdout: &auth,
+	}), gc.IsNil)
+	// Someone else can't copy the object, or delete it by copying.
+	c.Assert(cmd.NewCopyCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":    s.server.URL,
+			"to-url": s.server.URL,
+			"home":   c.MkDir(),
+			"delete": true,
+		},
+		stdin: bytes.NewBuffer(auth.Bytes()),
+	}), gc.ErrorMatches, `cannot copy: client:encrypt caveat is not addressed to this key`)
+	var out bytes.Buffer
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": s.home,
+		},
+		stdin: bytes.NewBuffer(auth.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "hello world")
+}
+
+func (s *cmdSuite) TestBatch(c *gc.C) {
+	dir := c.MkDir()
+	flags := map[string]interface{}{
+		"url":     s.server.URL,
+		"home":    s.home,
+		"workers": "2",
+	}
+	var manifest bytes.Buffer
+	for i := 0; i < 3; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("%d", i))
+		c.Assert(ioutil.WriteFile(name, []byte(fmt.Sprintf("hello %d", i)), 0600), gc.IsNil)
+		fmt.Fprintf(&manifest, `{"op":"new","input":%q,"output":%q}`+"\n", name, name+".auth")
+	}
+	c.Assert(cmd.NewBatchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: &manifest,
+	}), gc.IsNil)
+
+	for i := 0; i < 3; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("%d", i))
+		fmt.Fprintf(&manifest, `{"op":"fetch","input":%q,"output":%q,"caveats":["operation fetch"]}`+"\n", name+".auth", name+".out")
+	}
+	c.Assert(cmd.NewBatchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: &manifest,
+	}), gc.IsNil)
+	for i := 0; i < 3; i++ {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.out", i)))
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(contents), gc.Equals, fmt.Sprintf("hello %d", i))
+	}
+
+	// The attenuated fetch auth can't be used to delete.
+	var results bytes.Buffer
+	fmt.Fprintf(&manifest, `{"op":"delete","input":%q}`+"\n", filepath.Join(dir, "0.auth"))
+	fmt.Fprintf(&manifest, `{"op":"delete","input":%q,"caveats":["operation fetch"]}`+"\n", filepath.Join(dir, "1.auth"))
+	c.Assert(cmd.NewBatchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: &manifest, stdout: &results,
+	}), gc.ErrorMatches, `1 of 2 operations failed`)
+	c.Assert(results.String(), gc.Matches, `(?s){"item":1,"op":"delete",[^\n]*}\n{"item":2,"op":"delete",.*"error":"403 Forbidden.*\n`)
+}
+
+func (s *cmdSuite) TestArchive(c *gc.C) {
+	src := c.MkDir()
+	c.Assert(os.MkdirAll(filepath.Join(src, "certs"), 0700), gc.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "config"), []byte("foo: bar"), 0644), gc.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(src, "certs", "key.pem"), []byte("secret"), 0600), gc.IsNil)
+
+	for _, format := range []string{"tar", "tar.gz", "tar.zst"} {
+		var auth bytes.Buffer
+		c.Assert(cmd.NewNewCommand().Do(&StubContext{
+			flags: map[string]interface{}{
+				"url":            s.server.URL,
+				"home":           s.home,
+				"dir":            src,
+				"archive-format": format,
+			},
+			stdout: &auth,
+		}), gc.IsNil)
+		dest := filepath.Join(c.MkDir(), "dest")
+		c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+			flags: map[string]interface{}{
+				"url":     s.server.URL,
+				"home":    s.home,
+				"extract": dest,
+			},
+			stdin: &auth,
+		}), gc.IsNil)
+		contents, err := ioutil.ReadFile(filepath.Join(dest, "config"))
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(contents), gc.Equals, "foo: bar")
+		contents, err = ioutil.ReadFile(filepath.Join(dest, "certs", "key.pem"))
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(contents), gc.Equals, "secret")
+		fi, err := os.Stat(filepath.Join(dest, "certs", "key.pem"))
+		c.Assert(err, gc.IsNil)
+		c.Assert(fi.Mode().Perm(), gc.Equals, os.FileMode(0600))
+	}
+}
+
+func (s *cmdSuite) TestExtractLinkChain(c *gc.C) {
+	// Each link stays inside the destination on its own, but together they
+	// would lead a/b/x to the parent of the destination.
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, hdr := range []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "."},
+		{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: ".."},
+		{Name: "a/b/x", Typeflag: tar.TypeReg, Mode: 0600, Size: 5},
+	} {
+		c.Assert(tw.WriteHeader(hdr), gc.IsNil)
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte("owned"))
+			c.Assert(err, gc.IsNil)
+		}
+	}
+	c.Assert(tw.Close(), gc.IsNil)
+
+	var auth bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":          s.server.URL,
+			"home":         s.home,
+			"content-type": "application/x-tar",
+		},
+		stdin: &archive, stdout: &auth,
+	}), gc.IsNil)
+	parent := c.MkDir()
+	dest := filepath.Join(parent, "dest")
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":     s.server.URL,
+			"home":    s.home,
+			"extract": dest,
+		},
+		stdin: &auth,
+	}), gc.ErrorMatches, `.*refusing to extract "a/b": path through link .*`)
+	_, err := os.Lstat(filepath.Join(parent, "x"))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+}
+
+func (s *cmdSuite) TestExtractLimits(c *gc.C) {
+	// A file of zeros compresses to almost nothing, but would extract to
+	// more than the limit.
+	var archive bytes.Buffer
+	zw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(zw)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "zeros", Typeflag: tar.TypeReg, Mode: 0600, Size: 1 << 20}), gc.IsNil)
+	_, err := tw.Write(make([]byte, 1<<20))
+	c.Assert(err, gc.IsNil)
+	for i := 0; i < 3; i++ {
+		c.Assert(tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("dir%d/", i), Typeflag: tar.TypeDir, Mode: 0700}), gc.IsNil)
+	}
+	c.Assert(tw.Close(), gc.IsNil)
+	c.Assert(zw.Close(), gc.IsNil)
+	c.Assert(archive.Len() < 1<<16, gc.Equals, true)
+
+	var auth bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":          s.server.URL,
+			"home":         s.home,
+			"content-type": "application/x-tar+gzip",
+		},
+		stdin: &archive, stdout: &auth,
+	}), gc.IsNil)
+	extract := func(size int64, entries int) error {
+		defer cmd.SetArchiveLimits(size, entries)()
+		return cmd.NewFetchCommand().Do(&StubContext{
+			flags: map[string]interface{}{
+				"url":     s.server.URL,
+				"home":    s.home,
+				"extract": filepath.Join(c.MkDir(), "dest"),
+			},
+			stdin: bytes.NewBuffer(auth.Bytes()),
+		})
+	}
+	c.Assert(extract(1<<16, 10), gc.ErrorMatches, `archive exceeds 65536 bytes`)
+	c.Assert(extract(1<<21, 3), gc.ErrorMatches, `archive exceeds 3 entries`)
+	c.Assert(extract(1<<21, 4), gc.IsNil)
+}
+
+func (s *cmdSuite) TestExtractNotArchive(c *gc.C) {
+	var auth bytes.Buffer
+	flags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": s.home,
+	}
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBufferString("hello world"), stdout: &auth,
+	}), gc.IsNil)
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":     s.server.URL,
+			"home":    s.home,
+			"extract": c.MkDir(),
+		},
+		stdin: &auth,
+	}), gc.ErrorMatches, `cannot extract: object is not an archive`)
+}
+
+func (s *cmdSuite) TestRestoreInspect(c *gc.C) {
+	src := filepath.Join(c.MkDir(), "notes.txt")
+	c.Assert(ioutil.WriteFile(src, []byte("hello world"), 0640), gc.IsNil)
+	mtime := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.Assert(os.Chtimes(src, mtime, mtime), gc.IsNil)
+
+	var auth, info bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":          s.server.URL,
+			"home":         s.home,
+			"input":        src,
+			"content-type": "text/plain",
+		},
+		stdout: &auth,
+	}), gc.IsNil)
+	flags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": s.home,
+	}
+	c.Assert(cmd.NewInspectCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(auth.Bytes()), stdout: &info,
+	}), gc.IsNil)
+	c.Assert(info.String(), gc.Matches, `filename: notes.txt
+content-type: text/plain
+size: 11
+modified: 2015-06-01T12:00:00Z
+mode: -rw-r-----
+sha384: [0-9a-f]{96} verified
+`)
+
+	wd, err := os.Getwd()
+	c.Assert(err, gc.IsNil)
+	defer os.Chdir(wd)
+	dest := c.MkDir()
+	c.Assert(os.Chdir(dest), gc.IsNil)
+	restoreFlags := map[string]interface{}{
+		"url":     s.server.URL,
+		"home":    s.home,
+		"restore": true,
+	}
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: restoreFlags,
+		stdin: bytes.NewBuffer(auth.Bytes()),
+	}), gc.IsNil)
+	restored := filepath.Join(dest, "notes.txt")
+	contents, err := ioutil.ReadFile(restored)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(contents), gc.Equals, "hello world")
+	fi, err := os.Stat(restored)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fi.Mode().Perm(), gc.Equals, os.FileMode(0640))
+	c.Assert(fi.ModTime().Equal(mtime), gc.Equals, true)
+	// an existing file is not overwritten
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: restoreFlags,
+		stdin: bytes.NewBuffer(auth.Bytes()),
+	}), gc.ErrorMatches, `cannot restore: .*file exists`)
+}
+
+func (s *cmdSuite) TestCompress(c *gc.C) {
+	contents := bytes.Repeat([]byte(`{"level":"info","msg":"hello world"}`+"\n"), 1000)
+	for _, alg := range []string{"zstd", "gzip"} {
+		var auth, out bytes.Buffer
+		c.Assert(cmd.NewNewCommand().Do(&StubContext{
+			flags: map[string]interface{}{
+				"url":      s.server.URL,
+				"home":     s.home,
+				"compress": alg,
+			},
+			stdin: bytes.NewBuffer(contents), stdout: &auth,
+		}), gc.IsNil)
+		c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+			flags: map[string]interface{}{
+				"url":  s.server.URL,
+				"home": s.home,
+			},
+			stdin: &auth, stdout: &out,
+		}), gc.IsNil)
+		c.Assert(out.Bytes(), gc.DeepEquals, contents)
+
+		// decompression stops at the size the envelope records
+		compressed, err := cmd.Compress(contents, alg)
+		c.Assert(err, gc.IsNil)
+		size := int64(len(contents))
+		_, err = cmd.Decompress(compressed, alg, size-1)
+		c.Assert(err, gc.ErrorMatches, fmt.Sprintf(`decompressed contents exceed %d bytes`, size-1))
+		_, err = cmd.Decompress(compressed, alg, size+1)
+		c.Assert(err, gc.ErrorMatches, fmt.Sprintf(`decompressed contents are %d bytes, expected %d`, size, size+1))
+		plain, err := cmd.Decompress(compressed, alg, size)
+		c.Assert(err, gc.IsNil)
+		c.Assert(plain, gc.DeepEquals, contents)
+	}
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":      s.server.URL,
+			"home":     s.home,
+			"compress": "lzma",
+		},
+		stdin: bytes.NewBuffer(contents),
+	}), gc.ErrorMatches, `invalid --compress "lzma", expected zstd or gzip`)
+}
+
+func (s *cmdSuite) TestPad(c *gc.C) {
+	// Record the size of each object stored, which is all the service
+	// learns of its contents.
+	service, err := oostore.NewService(oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+	})
+	c.Assert(err, gc.IsNil)
+	var (
+		mu     sync.Mutex
+		stored []int
+	)
+	storedSizes := func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		sizes := stored
+		stored = nil
+		return sizes
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			body, err := ioutil.ReadAll(req.Body)
+			c.Check(err, gc.IsNil)
+			mu.Lock()
+			stored = append(stored, len(body))
+			mu.Unlock()
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		service.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	secrets := []string{"x", "hunter2", strings.Repeat("correct horse battery staple ", 8)}
+	for _, pad := range []string{"pow2", "4096"} {
+		for _, alg := range []string{"", "zstd"} {
+			for _, secret := range secrets {
+				var auth, out bytes.Buffer
+				c.Assert(cmd.NewNewCommand().Do(&StubContext{
+					flags: map[string]interface{}{
+						"url":      srv.URL,
+						"home":     s.home,
+						"pad":      pad,
+						"compress": alg,
+					},
+					stdin: bytes.NewBufferString(secret), stdout: &auth,
+				}), gc.IsNil)
+				c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+					flags: map[string]interface{}{
+						"url":  srv.URL,
+						"home": s.home,
+					},
+					stdin: &auth, stdout: &out,
+				}), gc.IsNil)
+				c.Assert(out.String(), gc.Equals, secret)
+			}
+			sizes := storedSizes()
+			c.Assert(sizes, gc.HasLen, len(secrets))
+			for _, size := range sizes {
+				if pad == "pow2" {
+					// short secrets all fill the smallest bucket
+					c.Assert(size, gc.Equals, 256+cmd.SealOverhead)
+				} else {
+					c.Assert((size-cmd.SealOverhead)%4096, gc.Equals, 0)
+				}
+			}
+		}
+	}
+
+	// longer contents are padded to the next block
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  srv.URL,
+			"home": s.home,
+			"pad":  "4096",
+		},
+		stdin: bytes.NewBuffer(make([]byte, 5000)), stdout: ioutil.Discard,
+	}), gc.IsNil)
+	c.Assert(storedSizes(), gc.DeepEquals, []int{8192 + cmd.SealOverhead})
+
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": s.home,
+			"pad":  "0",
+		},
+		stdin: bytes.NewBufferString("hunter2"),
+	}), gc.ErrorMatches, `invalid --pad "0", expected pow2 or a block size of 1 to 16777216 bytes`)
+}
+
+func (s *cmdSuite) TestPromptFlags(c *gc.C) {
+	for _, t := range []struct {
+		flags map[string]interface{}
+		err   string
+	}{{
+		flags: map[string]interface{}{"prompt": true, "input": "secret.txt"},
+		err:   `--prompt cannot be used with --input or --dir`,
+	}, {
+		flags: map[string]interface{}{"multiline": true},
+		err:   `--confirm and --multiline require --prompt`,
+	}} {
+		t.flags["url"] = s.server.URL
+		t.flags["home"] = s.home
+		c.Assert(cmd.NewNewCommand().Do(&StubContext{
+			flags: t.flags,
+			stdin: bytes.NewBufferString("hunter2"),
+		}), gc.ErrorMatches, t.err)
+	}
+}
+
+func (s *cmdSuite) TestFetchOutput(c *gc.C) {
+	var auth bytes.Buffer
+	flags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": s.home,
+	}
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBufferString("hunter2"), stdout: &auth,
+	}), gc.IsNil)
+	dir := c.MkDir()
+	fetch := func(output string, extra map[string]interface{}) error {
+		fetchFlags := map[string]interface{}{
+			"url":    s.server.URL,
+			"home":   s.home,
+			"output": output,
+		}
+		for k, v := range extra {
+			fetchFlags[k] = v
+		}
+		return cmd.NewFetchCommand().Do(&StubContext{
+			flags: fetchFlags,
+			stdin: bytes.NewBuffer(auth.Bytes()),
+		})
+	}
+
+	// written with mode 0600 by default, or --mode
+	for _, t := range []struct {
+		mode     string
+		expected os.FileMode
+	}{{"", 0600}, {"0640", 0640}} {
+		output := filepath.Join(dir, "pwd"+t.mode)
+		c.Assert(fetch(output, map[string]interface{}{"mode": t.mode}), gc.IsNil)
+		contents, err := ioutil.ReadFile(output)
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(contents), gc.Equals, "hunter2")
+		fi, err := os.Stat(output)
+		c.Assert(err, gc.IsNil)
+		c.Assert(fi.Mode().Perm(), gc.Equals, t.expected)
+	}
+
+	// an existing file is kept with --no-clobber
+	existing := filepath.Join(dir, "existing")
+	c.Assert(ioutil.WriteFile(existing, []byte("keep"), 0600), gc.IsNil)
+	c.Assert(fetch(existing, map[string]interface{}{"no-clobber": true}), gc.ErrorMatches, `cannot write .*already exists`)
+	contents, err := ioutil.ReadFile(existing)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(contents), gc.Equals, "keep")
+
+	// a failed fetch leaves nothing behind
+	c.Assert(cmd.NewDeleteCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(auth.Bytes()),
+	}), gc.IsNil)
+	c.Assert(fetch(filepath.Join(dir, "missing"), nil), gc.ErrorMatches, `^404 Not Found.*`)
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 3)
+}
+
+func (s *cmdSuite) TestTTLGC(c *gc.C) {
+	var auth, out bytes.Buffer
+	flags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": s.home,
+	}
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": s.home,
+			"ttl":  "1s",
+		},
+		stdin: bytes.NewBufferString("hunter2"), stdout: &auth,
+	}), gc.IsNil)
+	// nothing has expired yet
+	c.Assert(cmd.NewGCCommand().Do(&StubContext{
+		flags: flags, stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "")
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(auth.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Equals, "hunter2")
+
+	time.Sleep(1500 * time.Millisecond)
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(auth.Bytes()),
+	}), gc.ErrorMatches, `^403 Forbidden.*`)
+	out.Reset()
+	c.Assert(cmd.NewGCCommand().Do(&StubContext{
+		flags: flags, stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.String(), gc.Matches, `http://.*/.* deleted\n`)
+	entries, err := ioutil.ReadDir(filepath.Join(s.home, "ledger"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 0)
+
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":  s.server.URL,
+			"home": s.home,
+			"ttl":  "0",
+		},
+		stdin: bytes.NewBufferString("hunter2"),
+	}), gc.ErrorMatches, `invalid --ttl "0"`)
+}
+
+func (s *cmdSuite) TestShards(c *gc.C) {
+	contents := bytes.Repeat([]byte("hello world "), 100)
+	var auth bytes.Buffer
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":        s.server.URL,
+			"home":       s.home,
+			"shard-size": "256",
+		},
+		stdin: bytes.NewBuffer(contents), stdout: &auth,
+	}), gc.IsNil)
+	c.Assert(auth.String(), gc.Matches, `(?s){"shards":\[{"index":0,.*{"index":4,.*`)
+
+	flags := map[string]interface{}{
+		"url":  s.server.URL,
+		"home": s.home,
+	}
+	var out bytes.Buffer
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(auth.Bytes()), stdout: &out,
+	}), gc.IsNil)
+	c.Assert(out.Bytes(), gc.DeepEquals, contents)
+
+	c.Assert(cmd.NewDeleteCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(auth.Bytes()),
+	}), gc.IsNil)
+	c.Assert(cmd.NewFetchCommand().Do(&StubContext{
+		flags: flags,
+		stdin: bytes.NewBuffer(auth.Bytes()),
+	}), gc.ErrorMatches, `failed to fetch shard 0: 404 Not Found.*`)
+}
+
+func (s *cmdSuite) TestShardsConcurrency(c *gc.C) {
+	service, err := oostore.NewService(oostore.ServiceConfig{
+		ObjectStore: oostore.NewMemStorage(),
+	})
+	c.Assert(err, gc.IsNil)
+	var posts, inFlight, maxInFlight, stored, deleted int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			if atomic.AddInt32(&posts, 1) == 7 {
+				http.Error(w, "full", http.StatusServiceUnavailable)
+				return
+			}
+			atomic.AddInt32(&stored, 1)
+		case "DELETE":
+			atomic.AddInt32(&deleted, 1)
+		}
+		service.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	c.Assert(cmd.NewNewCommand().Do(&StubContext{
+		flags: map[string]interface{}{
+			"url":        srv.URL,
+			"home":       s.home,
+			"shard-size": "64",
+		},
+		stdin: bytes.NewBuffer(bytes.Repeat([]byte("hello world "), 100)),
+	}), gc.ErrorMatches, `failed to store shard \d+: 503 Service Unavailable.*`)
+	c.Assert(atomic.LoadInt32(&maxInFlight) <= cmd.ShardWorkers, gc.Equals, true)
+	// every shard that was stored is deleted again
+	c.Assert(atomic.LoadInt32(&stored) > 0, gc.Equals, true)
+	c.Assert(atomic.LoadInt32(&deleted), gc.Equals, atomic.LoadInt32(&stored))
+}
+
 // StubContext implements cmd.Context for stub testing purposes.
 type StubContext struct {
 	args   []string
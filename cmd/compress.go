@@ -0,0 +1,116 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms, given to --compress.
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// maxDecompressedSize bounds the output of decompression, whatever size the
+// envelope records.
+const maxDecompressedSize = 1 << 30
+
+// parseCompression checks a --compress algorithm.
+func parseCompression(alg string) (string, error) {
+	switch alg {
+	case "", compressGzip, compressZstd:
+		return alg, nil
+	}
+	return "", fmt.Errorf("invalid --compress %q, expected zstd or gzip", alg)
+}
+
+// compress returns buf compressed with the given algorithm, in a secure
+// buffer.
+func compress(buf []byte, alg string) (*secureBuffer, error) {
+	out := newSecureBuffer(0)
+	var w io.WriteCloser
+	var err error
+	switch alg {
+	case compressGzip:
+		w = gzip.NewWriter(out)
+	case compressZstd:
+		w, err = zstd.NewWriter(out)
+	default:
+		err = fmt.Errorf("unsupported compression %q", alg)
+	}
+	if err == nil {
+		_, err = w.Write(buf)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		out.Destroy()
+		return nil, err
+	}
+	return out, nil
+}
+
+// decompress returns buf decompressed with the given algorithm, in a secure
+// buffer. The output must be exactly size bytes, if size is known, and no more
+// than maxDecompressedSize, so that a compression bomb is cut short.
+func decompress(buf []byte, alg string, size int64) (*secureBuffer, error) {
+	var r io.Reader
+	switch alg {
+	case compressGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress contents: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	case compressZstd:
+		zr, err := zstd.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress contents: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", alg)
+	}
+
+	limit := int64(maxDecompressedSize)
+	if size > 0 && size < limit {
+		limit = size
+	}
+	out, err := readSecure(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress contents: %v", err)
+	}
+	if int64(out.Len()) > limit {
+		out.Destroy()
+		return nil, fmt.Errorf("decompressed contents exceed %d bytes", limit)
+	}
+	if size > 0 && int64(out.Len()) != size {
+		n := out.Len()
+		out.Destroy()
+		return nil, fmt.Errorf("decompressed contents are %d bytes, expected %d", n, size)
+	}
+	return out, nil
+}
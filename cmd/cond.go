@@ -17,10 +17,10 @@
 package cmd
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"strings"
 
@@ -55,6 +55,18 @@ func (c *condCommand) CLICommand() cli.Command {
 			cli.StringFlag{
 				Name: "output, o",
 			},
+			cli.StringFlag{
+				Name:   "auth-format",
+				EnvVar: "OO_AUTH_FORMAT",
+				Usage:  "auth output format: json, b64, armor or binary",
+				Value:  "json",
+			},
+			cli.StringFlag{
+				Name:   "macaroon-version",
+				EnvVar: "OO_MACAROON_VERSION",
+				Usage:  "macaroon serialization version of output auths: 1 or 2",
+				Value:  "1",
+			},
 			cli.StringFlag{
 				Name:  "location, loc, l",
 				Usage: "location of service for third-party caveat",
@@ -63,6 +75,10 @@ func (c *condCommand) CLICommand() cli.Command {
 				Name:  "key, k",
 				Usage: "base64-encoded public key of third-party service",
 			},
+			cli.StringFlag{
+				Name:  "totp",
+				Usage: "require a TOTP code for issuer from a totp discharge service",
+			},
 		},
 	}
 }
@@ -70,9 +86,8 @@ func (c *condCommand) CLICommand() cli.Command {
 // Do implements Command.
 func (c *condCommand) Do(ctx Context) error {
 	var (
-		input  io.ReadCloser
-		output io.WriteCloser
-		err    error
+		input io.ReadCloser
+		err   error
 	)
 
 	inputFile := ctx.String("input")
@@ -86,16 +101,10 @@ func (c *condCommand) Do(ctx Context) error {
 	}
 	defer input.Close()
 
-	outputFile := ctx.String("output")
-	if outputFile == "" {
-		output = ctx.Stdout()
-	} else {
-		output, err = os.Create(outputFile)
-		if err != nil {
-			return fmt.Errorf("cannot create %q for output: %v", outputFile, err)
-		}
+	format, err := authFormat(ctx)
+	if err != nil {
+		return err
 	}
-	defer output.Close()
 
 	urlStr := ctx.String("url")
 	if urlStr == "" {
@@ -110,14 +119,25 @@ func (c *condCommand) Do(ctx Context) error {
 	if len(ms) == 0 {
 		return fmt.Errorf("missing auth")
 	}
-	if len(ctx.Args()) == 0 {
-		ctx.ShowAppHelp()
-		return fmt.Errorf("missing condition arguments")
+	location := ctx.String("location")
+	var condition string
+	if issuer := ctx.String("totp"); issuer != "" {
+		if len(ctx.Args()) != 0 {
+			return fmt.Errorf("--totp does not take condition arguments")
+		}
+		location, err = totpLocation(location)
+		if err != nil {
+			return err
+		}
+		condition = "totp " + issuer
+	} else {
+		if len(ctx.Args()) == 0 {
+			ctx.ShowAppHelp()
+			return fmt.Errorf("missing condition arguments")
+		}
+		condition = strings.Join(ctx.Args(), " ")
 	}
 
-	condition := strings.Join(ctx.Args(), " ")
-
-	location := ctx.String("location")
 	if location == "" {
 		err = ms[0].AddFirstPartyCaveat(condition)
 		if err != nil {
@@ -130,11 +150,34 @@ func (c *condCommand) Do(ctx Context) error {
 		}
 	}
 
-	err = json.NewEncoder(output).Encode(ms)
+	return writeCtxOutput(ctx, func(w io.Writer) error {
+		err := encodeAuth(w, ms, format)
+		if err != nil {
+			return fmt.Errorf("failed to encode auth: %v", err)
+		}
+		return nil
+	})
+}
+
+// defaultTOTPLocation is the location of a TOTP discharge service run with
+// discharge-server defaults.
+var defaultTOTPLocation = "http://127.0.0.1:8080" + totpPath
+
+// totpLocation returns the location of the TOTP discharge service for a
+// --totp caveat, given the --location flag, which may omit the path.
+func totpLocation(location string) (string, error) {
+	if location == "" {
+		return defaultTOTPLocation, nil
+	}
+	u, err := url.Parse(location)
 	if err != nil {
-		return fmt.Errorf("failed to encode auth: %v", err)
+		return "", fmt.Errorf("invalid location %q: %v", location, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	if !strings.HasSuffix(u.Path, totpPath) {
+		u.Path += totpPath
 	}
-	return nil
+	return u.String(), nil
 }
 
 type condContext struct {
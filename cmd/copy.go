@@ -0,0 +1,313 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon.v1"
+)
+
+type copyCommand struct{}
+
+// NewCopyCommand returns a Command that copies opaque objects from one oostore
+// service to another.
+func NewCopyCommand() *copyCommand {
+	return &copyCommand{}
+}
+
+// CLICommand implements Command.
+func (c *copyCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:    "copy",
+		Aliases: []string{"cp"},
+		Usage:   "copy opaque objects to another oostore service",
+		Action:  Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "url, from-url",
+				EnvVar: "OOSTORE_URL",
+				Value:  defaultURL,
+			},
+			cli.StringFlag{
+				Name:  "to-url",
+				Usage: "location of oostore service to copy objects to",
+			},
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name:  "input, i",
+				Usage: "auth file, or directory of auth files",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Usage: "auth file, or directory of auth files if input is a directory",
+			},
+			cli.StringFlag{
+				Name:   "auth-format",
+				EnvVar: "OO_AUTH_FORMAT",
+				Usage:  "auth output format: json, b64, armor or binary",
+				Value:  "json",
+			},
+			cli.StringFlag{
+				Name:   "macaroon-version",
+				EnvVar: "OO_MACAROON_VERSION",
+				Usage:  "macaroon serialization version of output auths: 1 or 2",
+				Value:  "1",
+			},
+			cli.StringFlag{
+				Name: "to, t",
+			},
+			cli.BoolFlag{
+				Name:  "reencrypt",
+				Usage: "encrypt copies with a fresh envelope",
+			},
+			cli.BoolFlag{
+				Name:  "delete",
+				Usage: "delete the original objects once copied",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *copyCommand) Do(ctx Context) error {
+	from, err := newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer from.close()
+	toURL := ctx.String("to-url")
+	if toURL == "" {
+		ctx.ShowAppHelp()
+		return errors.New("--to-url is required")
+	}
+	format, err := authFormat(ctx)
+	if err != nil {
+		return err
+	}
+	cp := &copier{
+		from:       from,
+		to:         from.at(toURL),
+		reencrypt:  ctx.Bool("reencrypt"),
+		delete:     ctx.Bool("delete"),
+		authFormat: format,
+	}
+	cp.recipient, err = recipientKey(ctx, from.key)
+	if err != nil {
+		return err
+	}
+
+	inputFile := ctx.String("input")
+	if inputFile != "" {
+		fi, err := os.Stat(inputFile)
+		if err != nil {
+			return fmt.Errorf("cannot open %q for input: %v", inputFile, err)
+		}
+		if fi.IsDir() {
+			return cp.copyDir(inputFile, ctx.String("output"))
+		}
+	}
+
+	var input io.ReadCloser
+	if inputFile == "" {
+		input = ctx.Stdin()
+	} else {
+		input, err = os.Open(inputFile)
+		if err != nil {
+			return fmt.Errorf("cannot open %q for input: %v", inputFile, err)
+		}
+	}
+	defer input.Close()
+
+	outputFile := ctx.String("output")
+	if outputFile != "" {
+		return cp.copyAuth(input, cp.writeAuthFile(outputFile))
+	}
+	return cp.copyAuth(input, func(newAuth macaroon.Slice) error {
+		output := ctx.Stdout()
+		defer output.Close()
+		return encodeAuth(output, newAuth, cp.authFormat)
+	})
+}
+
+// copier copies objects between two oostore services.
+type copier struct {
+	from, to   *session
+	recipient  *bakery.PublicKey
+	reencrypt  bool
+	delete     bool
+	authFormat authEncoding
+}
+
+// copyDir copies the object of each auth file in inputDir, writing the new
+// auth files to outputDir under the same names. Failures are logged and
+// copying continues with the next file.
+func (cp *copier) copyDir(inputDir, outputDir string) error {
+	if outputDir == "" {
+		return errors.New("--output directory is required when input is a directory")
+	}
+	err := os.MkdirAll(outputDir, 0700)
+	if err != nil {
+		return fmt.Errorf("cannot create %q for output: %v", outputDir, err)
+	}
+	entries, err := ioutil.ReadDir(inputDir)
+	if err != nil {
+		return fmt.Errorf("cannot read %q: %v", inputDir, err)
+	}
+	var failed int
+	for _, fi := range entries {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		inputFile := filepath.Join(inputDir, fi.Name())
+		outputFile := filepath.Join(outputDir, fi.Name())
+		err := cp.copyFile(inputFile, outputFile)
+		if err != nil {
+			log.Printf("%s: %v", inputFile, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to copy %d of %d objects", failed, len(entries))
+	}
+	return nil
+}
+
+func (cp *copier) copyFile(inputFile, outputFile string) error {
+	input, err := os.Open(inputFile)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	return cp.copyAuth(input, cp.writeAuthFile(outputFile))
+}
+
+// writeAuthFile returns a function which replaces outputFile atomically with
+// an auth, so that a failed write leaves nothing behind.
+func (cp *copier) writeAuthFile(outputFile string) func(macaroon.Slice) error {
+	return func(newAuth macaroon.Slice) error {
+		err := writeFileAtomic(outputFile, 0600, false, func(w io.Writer) error {
+			return encodeAuth(w, newAuth, cp.authFormat)
+		})
+		if err != nil {
+			return fmt.Errorf("cannot write %q for output: %v", outputFile, err)
+		}
+		return nil
+	}
+}
+
+// copyAuth copies the object authorized by the auth read from r, passing the
+// auth for the copy to write.
+func (cp *copier) copyAuth(r io.Reader, write func(macaroon.Slice) error) error {
+	ms, err := unmarshalAuth(r)
+	if err != nil {
+		return err
+	}
+	return cp.copy(ms, write)
+}
+
+// copy fetches the object authorized by ms and stores it in the destination
+// service. The ciphertext is copied as-is under the original envelope unless
+// re-encryption was requested. Either way, the new auth is addressed to the
+// copier's recipient, and passed to write. If that fails, the copy is
+// deleted. With delete, the original is only deleted once the copy has been
+// verified and its auth written.
+func (cp *copier) copy(ms macaroon.Slice, write func(macaroon.Slice) error) error {
+	ms, env, err := cp.from.discharge(ms)
+	if err != nil {
+		return err
+	}
+	// env is replaced when re-encrypting; whichever is current is wiped.
+	defer func() { env.wipe() }()
+	if env == nil && hasEncryptCaveat(ms[0]) {
+		// The contents are encrypted, but not to us. A copy would be
+		// ciphertext nobody can decrypt.
+		return errors.New("cannot copy: client:encrypt caveat is not addressed to this key")
+	}
+	body, err := cp.from.fetchObject(ms)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var contents io.Reader = body
+	if cp.reencrypt {
+		var meta metadata
+		var opts sealOptions
+		if env != nil {
+			contents, err = env.decrypt(body)
+			if err != nil {
+				return fmt.Errorf("error decrypting contents: %v", err)
+			}
+			meta = env.metadata
+			opts.compression = env.compression
+			opts.padding = env.padding
+			env.wipe()
+		}
+		env, contents, err = encrypt(ioutil.NopCloser(contents), opts)
+		if err != nil {
+			return err
+		}
+		env.metadata = meta
+	}
+
+	newAuth, err := cp.to.newObject(contents, "")
+	if err != nil {
+		return err
+	}
+	if cp.delete && env != nil {
+		// The copy is read back and verified with the auth issued by the
+		// service, before the client:encrypt caveat is added, so that the
+		// original is only deleted if the copy can be decrypted.
+		err = cp.to.verify(newAuth, env)
+	}
+	m := newAuth[0].Clone()
+	if err == nil && env != nil {
+		err = cp.to.addEncryptCaveat(m, env, cp.recipient)
+		if err != nil {
+			err = fmt.Errorf("failed to add third-party caveat: %v", err)
+		}
+	}
+	if err == nil {
+		err = write(append(macaroon.Slice{m}, newAuth[1:]...))
+	}
+	if err != nil {
+		if rbErr := cp.to.deleteObject(newAuth); rbErr != nil {
+			log.Printf("failed to delete copy: %v", rbErr)
+		}
+		return fmt.Errorf("copy failed: %v", err)
+	}
+	if cp.delete {
+		err = cp.from.deleteObject(ms)
+		if err != nil {
+			return fmt.Errorf("copied, but failed to delete original: %v", err)
+		}
+	}
+	return nil
+}
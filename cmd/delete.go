@@ -17,12 +17,9 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"io/ioutil"
 	"os"
 
 	"github.com/codegangsta/cli"
@@ -56,6 +53,23 @@ func (c *deleteCommand) CLICommand() cli.Command {
 			cli.StringFlag{
 				Name: "input, i",
 			},
+			cli.StringFlag{
+				Name:  "discharge-timeout",
+				Usage: "how long to wait for each third-party discharge",
+				Value: "10m",
+			},
+			cli.BoolFlag{
+				Name:  "browser",
+				Usage: "open web pages for interactive discharge in a browser",
+			},
+			cli.BoolFlag{
+				Name:  "non-interactive",
+				Usage: "fail if a discharge requires interaction",
+			},
+			cli.BoolFlag{
+				Name:  "no-discharge-cache",
+				Usage: "do not use or store cached discharges",
+			},
 		},
 	}
 }
@@ -78,43 +92,14 @@ func (c *deleteCommand) Do(ctx Context) error {
 	}
 	defer input.Close()
 
-	urlStr := ctx.String("url")
-	if urlStr == "" {
-		ctx.ShowAppHelp()
-		return errors.New("--url or OOSTORE_URL is required")
-	}
-
-	var authBuf bytes.Buffer
-	ms, err := unmarshalAuth(input)
-	if err != nil {
-		return err
-	}
-	ms, _, err = dischargeAuth(ctx, ms)
-	if err != nil {
-		return err
-	}
-	id, err := objectID(ms)
-	if err != nil {
-		return err
-	}
-	err = json.NewEncoder(&authBuf).Encode(ms)
+	s, err := newSession(ctx)
 	if err != nil {
 		return err
 	}
-
-	req, err := http.NewRequest("DELETE", urlStr+"/"+id, bytes.NewBuffer(authBuf.Bytes()))
+	defer s.close()
+	authBuf, err := ioutil.ReadAll(input)
 	if err != nil {
-		return fmt.Errorf("failed to create request %q: %v", urlStr, err)
-	}
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("error requesting %q: %v", urlStr, err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusNoContent {
-		_, err = io.Copy(os.Stderr, resp.Body)
-		return err
+		return fmt.Errorf("failed to read input: %v", err)
 	}
-	return errHTTPResponse(resp)
+	return s.deleteAuth(authBuf)
 }
@@ -0,0 +1,391 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+)
+
+// dischargeRequest is a third-party caveat exported for discharge on another
+// host.
+type dischargeRequest struct {
+	Location string `json:"location"`
+	Id       string `json:"id"`
+}
+
+type dischargeCommand struct{}
+
+// NewDischargeCommand returns a Command that acquires discharges for the
+// third-party caveats of an auth ahead of time, or moves them between hosts
+// for discharge services that are offline.
+func NewDischargeCommand() *dischargeCommand {
+	return &dischargeCommand{}
+}
+
+// CLICommand implements Command.
+func (c *dischargeCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "discharge",
+		Usage:  "discharge all third-party caveats of auth, or offline: discharge [export|sign|import]",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "url",
+				EnvVar: "OOSTORE_URL",
+				Value:  defaultURL,
+			},
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name:  "identity",
+				Usage: "key file of the recipient discharging client:encrypt, if not $OO_HOME/key",
+			},
+			cli.StringFlag{
+				Name:  "discharge-timeout",
+				Usage: "how long to wait for each third-party discharge",
+				Value: "10m",
+			},
+			cli.BoolFlag{
+				Name:  "browser",
+				Usage: "open web pages for interactive discharge in a browser",
+			},
+			cli.BoolFlag{
+				Name:  "non-interactive",
+				Usage: "fail if a discharge requires interaction",
+			},
+			cli.BoolFlag{
+				Name:  "no-discharge-cache",
+				Usage: "do not use or store cached discharges",
+			},
+			cli.StringFlag{
+				Name: "input, i",
+			},
+			cli.StringFlag{
+				Name: "output, o",
+			},
+			cli.StringFlag{
+				Name:   "auth-format",
+				EnvVar: "OO_AUTH_FORMAT",
+				Usage:  "auth output format: json, b64, armor or binary",
+				Value:  "json",
+			},
+			cli.StringFlag{
+				Name:   "macaroon-version",
+				EnvVar: "OO_MACAROON_VERSION",
+				Usage:  "macaroon serialization version of output auths: 1 or 2",
+				Value:  "1",
+			},
+			cli.StringFlag{
+				Name:  "discharges, d",
+				Usage: "discharges to import, from discharge sign",
+			},
+			cli.StringFlag{
+				Name:  "checker",
+				Usage: "how conditions are checked when signing: allow, time or exec",
+				Value: "allow",
+			},
+			cli.StringFlag{
+				Name:  "allow",
+				Usage: "comma-separated conditions discharged by the allow checker",
+			},
+			cli.StringFlag{
+				Name:  "not-before",
+				Usage: "RFC3339 start of time checker window",
+			},
+			cli.StringFlag{
+				Name:  "not-after",
+				Usage: "RFC3339 end of time checker window",
+			},
+			cli.StringFlag{
+				Name:  "exec",
+				Usage: "program run by the exec checker to check each condition",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *dischargeCommand) Do(ctx Context) error {
+	args := ctx.Args()
+	if len(args) == 0 {
+		return c.bundle(ctx)
+	}
+	if len(args) != 1 {
+		ctx.ShowAppHelp()
+		return errors.New("usage: discharge [export|sign|import]")
+	}
+	switch args[0] {
+	case "export":
+		return c.export(ctx)
+	case "sign":
+		return c.sign(ctx)
+	case "import":
+		return c.importDischarges(ctx)
+	}
+	ctx.ShowAppHelp()
+	return fmt.Errorf("invalid discharge command %q", args[0])
+}
+
+// bundle acquires discharges for all third-party caveats in the auth,
+// including client:encrypt, and writes the bound auth. Whoever holds it can
+// fetch or delete the object without further discharges, until they expire.
+// client:encrypt is discharged with the --identity key, which must be the
+// recipient the caveat is addressed to.
+func (c *dischargeCommand) bundle(ctx Context) error {
+	ms, err := readInputAuth(ctx)
+	if err != nil {
+		return err
+	}
+	s, err := newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	if keyFile := ctx.String("identity"); keyFile != "" {
+		// The session is closed with whichever key it holds.
+		s.key.wipe()
+		s.key = newKeyPair()
+		err = s.key.load(keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load identity %q: %v", keyFile, err)
+		}
+	}
+	ms, env, err := s.discharge(ms)
+	if err != nil {
+		return fmt.Errorf("failed to discharge auth: %v", err)
+	}
+	env.wipe()
+	if env == nil && hasEncryptCaveat(ms[0]) {
+		return errors.New("cannot discharge client:encrypt caveat: not addressed to this identity")
+	}
+	return writeAuth(ctx, ms)
+}
+
+// export writes a discharge request for each third-party caveat in the auth
+// which is not yet discharged. client:encrypt caveats are left out; they are
+// discharged by the client when the object is fetched.
+func (c *dischargeCommand) export(ctx Context) error {
+	ms, err := readInputAuth(ctx)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool)
+	for _, m := range ms[1:] {
+		have[m.Id()] = true
+	}
+	var reqs []dischargeRequest
+	for _, cav := range thirdPartyCaveats(ms[0]) {
+		if cav.Location == "client:encrypt" || have[cav.Id] {
+			continue
+		}
+		reqs = append(reqs, dischargeRequest{Location: cav.Location, Id: cav.Id})
+	}
+	if len(reqs) == 0 {
+		return errors.New("no third-party caveats to discharge")
+	}
+	return writeOutput(ctx, reqs)
+}
+
+// sign discharges exported requests with the key in OO_HOME, checking each
+// condition as discharge-server would. Discharges are written for the
+// requests that could be discharged; if any could not, an error is returned
+// after they are written.
+func (c *dischargeCommand) sign(ctx Context) error {
+	checker, err := newDischargeChecker(ctx)
+	if err != nil {
+		return err
+	}
+	kp, err := keyManager{ctx}.keyPair()
+	if err != nil {
+		return fmt.Errorf("failed to load key: %v", err)
+	}
+	defer kp.wipe()
+	input, err := openInput(ctx)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	var reqs []dischargeRequest
+	err = json.NewDecoder(input).Decode(&reqs)
+	if err != nil {
+		return fmt.Errorf("failed to decode discharge requests: %v", err)
+	}
+
+	// There is no HTTP request when signing offline; checkers which look at
+	// one see an empty request.
+	req := &http.Request{Header: http.Header{}, URL: &url.URL{}, RemoteAddr: "offline"}
+	var discharges macaroon.Slice
+	var failed int
+	for _, r := range reqs {
+		dm, _, err := bakery.Discharge(kp.KeyPair, bakery.ThirdPartyCheckerFunc(
+			func(cavId, cav string) ([]checkers.Caveat, error) {
+				return checkDischarge(checker, req, cav)
+			}), r.Id)
+		if err != nil {
+			log.Printf("cannot discharge caveat for %s: %v", r.Location, err)
+			failed++
+			continue
+		}
+		discharges = append(discharges, dm)
+	}
+	if len(discharges) > 0 {
+		err = writeAuth(ctx, discharges)
+		if err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d caveats not discharged", failed, len(reqs))
+	}
+	return nil
+}
+
+// importDischarges binds discharges from discharge sign to the auth, so that
+// they are used instead of requesting discharges when the object is fetched
+// or deleted.
+func (c *dischargeCommand) importDischarges(ctx Context) error {
+	ms, err := readInputAuth(ctx)
+	if err != nil {
+		return err
+	}
+	dischargesFile := ctx.String("discharges")
+	if dischargesFile == "" {
+		return errors.New("--discharges is required")
+	}
+	f, err := os.Open(dischargesFile)
+	if err != nil {
+		return fmt.Errorf("cannot open %q: %v", dischargesFile, err)
+	}
+	defer f.Close()
+	discharges, err := unmarshalAuth(f)
+	if err != nil {
+		return err
+	}
+	ms, err = bindDischarges(ms, discharges)
+	if err != nil {
+		return err
+	}
+	return writeAuth(ctx, ms)
+}
+
+// bindDischarges returns ms with each discharge bound to its primary
+// macaroon and added, replacing any discharge already present for the same
+// caveat.
+func bindDischarges(ms, discharges macaroon.Slice) (macaroon.Slice, error) {
+	primary := ms[0]
+	wanted := make(map[string]bool)
+	for _, cav := range thirdPartyCaveats(primary) {
+		wanted[cav.Id] = true
+	}
+	bound := make(map[string]*macaroon.Macaroon)
+	for _, dm := range discharges {
+		if !wanted[dm.Id()] {
+			return nil, fmt.Errorf("discharge %q does not match any caveat in auth", dm.Id())
+		}
+		dm = dm.Clone()
+		dm.Bind(primary.Signature())
+		bound[dm.Id()] = dm
+	}
+	result := macaroon.Slice{primary}
+	for _, m := range ms[1:] {
+		if _, ok := bound[m.Id()]; !ok {
+			result = append(result, m)
+		}
+	}
+	for _, dm := range discharges {
+		result = append(result, bound[dm.Id()])
+	}
+	return result, nil
+}
+
+func openInput(ctx Context) (io.ReadCloser, error) {
+	inputFile := ctx.String("input")
+	if inputFile == "" {
+		return ctx.Stdin(), nil
+	}
+	f, err := os.Open(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %q for input: %v", inputFile, err)
+	}
+	return f, nil
+}
+
+func readInputAuth(ctx Context) (macaroon.Slice, error) {
+	input, err := openInput(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+	ms, err := unmarshalAuth(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(ms) == 0 {
+		return nil, errors.New("missing auth")
+	}
+	return ms, nil
+}
+
+// writeAuth writes ms to --output, or stdout, in the --auth-format.
+func writeAuth(ctx Context, ms macaroon.Slice) error {
+	format, err := authFormat(ctx)
+	if err != nil {
+		return err
+	}
+	return writeCtxOutput(ctx, func(w io.Writer) error {
+		return encodeAuth(w, ms, format)
+	})
+}
+
+// writeOutput JSON-encodes v to --output, or stdout.
+func writeOutput(ctx Context, v interface{}) error {
+	return writeCtxOutput(ctx, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(v)
+	})
+}
+
+// writeCtxOutput calls write with stdout, or if --output is given, with a
+// file that replaces it atomically, with mode 0600, once write succeeds. A
+// failed write leaves no partial output file behind.
+func writeCtxOutput(ctx Context, write func(io.Writer) error) error {
+	outputFile := ctx.String("output")
+	if outputFile == "" {
+		output := ctx.Stdout()
+		defer output.Close()
+		return write(output)
+	}
+	err := writeFileAtomic(outputFile, 0600, false, write)
+	if err != nil {
+		return fmt.Errorf("cannot write %q for output: %v", outputFile, err)
+	}
+	return nil
+}
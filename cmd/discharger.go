@@ -0,0 +1,195 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+)
+
+// dischargeChecker decides whether a third-party caveat condition addressed
+// to a discharge service may be discharged.
+type dischargeChecker interface {
+	// checkCondition returns the first-party caveats to add to the
+	// discharge macaroon if the condition is met, or an error if it is not.
+	checkCondition(req *http.Request, condition string) ([]checkers.Caveat, error)
+}
+
+// errEncryptCondition is returned for client:encrypt caveats. Their
+// condition is an object's envelope; a service which discharged them, or
+// reported why it would not, would reveal the envelope key to anyone holding
+// an auth for the object.
+var errEncryptCondition = errors.New("client:encrypt caveats are not discharged by this service")
+
+// isEncryptCondition returns whether condition is the envelope of a
+// client:encrypt caveat.
+func isEncryptCondition(condition string) bool {
+	var st envelopeJSON
+	return json.Unmarshal([]byte(condition), &st) == nil && len(st.Key) > 0
+}
+
+// checkDischarge checks condition with checker, refusing client:encrypt
+// conditions before the checker sees them.
+func checkDischarge(checker dischargeChecker, req *http.Request, condition string) ([]checkers.Caveat, error) {
+	if isEncryptCondition(condition) {
+		return nil, errEncryptCondition
+	}
+	return checker.checkCondition(req, condition)
+}
+
+// conditionID returns a short digest identifying condition in logs, without
+// revealing it.
+func conditionID(condition string) string {
+	sum := sha256.Sum256([]byte(condition))
+	return hex.EncodeToString(sum[:6])
+}
+
+// dischargeCheckers maps the checker kinds given to --checker to functions
+// which create them from command-line flags.
+var dischargeCheckers = map[string]func(ctx Context) (dischargeChecker, error){
+	"allow": newAllowChecker,
+	"time":  newTimeChecker,
+	"exec":  newExecChecker,
+	"totp":  newTOTPChecker,
+}
+
+func newDischargeChecker(ctx Context) (dischargeChecker, error) {
+	kind := ctx.String("checker")
+	newChecker, ok := dischargeCheckers[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown checker %q", kind)
+	}
+	return newChecker(ctx)
+}
+
+// allowChecker discharges conditions found in an allow-list.
+type allowChecker map[string]bool
+
+func newAllowChecker(ctx Context) (dischargeChecker, error) {
+	allow := allowChecker{}
+	for _, cond := range strings.Split(ctx.String("allow"), ",") {
+		cond = strings.TrimSpace(cond)
+		if cond != "" {
+			allow[cond] = true
+		}
+	}
+	if len(allow) == 0 {
+		return nil, fmt.Errorf("--allow is required for allow checker")
+	}
+	return allow, nil
+}
+
+func (c allowChecker) checkCondition(req *http.Request, condition string) ([]checkers.Caveat, error) {
+	if !c[condition] {
+		return nil, errors.New("condition not allowed")
+	}
+	return nil, nil
+}
+
+// timeChecker discharges any condition within a window of time. Discharges
+// expire at the end of the window.
+type timeChecker struct {
+	notBefore, notAfter time.Time
+}
+
+func newTimeChecker(ctx Context) (dischargeChecker, error) {
+	var c timeChecker
+	var err error
+	if s := ctx.String("not-before"); s != "" {
+		c.notBefore, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --not-before: %v", err)
+		}
+	}
+	if s := ctx.String("not-after"); s != "" {
+		c.notAfter, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --not-after: %v", err)
+		}
+	}
+	if c.notBefore.IsZero() && c.notAfter.IsZero() {
+		return nil, fmt.Errorf("--not-before or --not-after is required for time checker")
+	}
+	return &c, nil
+}
+
+func (c *timeChecker) checkCondition(req *http.Request, condition string) ([]checkers.Caveat, error) {
+	now := time.Now()
+	if !c.notBefore.IsZero() && now.Before(c.notBefore) {
+		return nil, fmt.Errorf("not before %s", c.notBefore.Format(time.RFC3339))
+	}
+	if c.notAfter.IsZero() {
+		return nil, nil
+	}
+	if now.After(c.notAfter) {
+		return nil, fmt.Errorf("not after %s", c.notAfter.Format(time.RFC3339))
+	}
+	return []checkers.Caveat{checkers.TimeBeforeCaveat(c.notAfter)}, nil
+}
+
+// execChecker runs a local program to decide on each condition. The condition
+// is written to the program's stdin, rather than given as an argument, where
+// other local users could see it. The condition is met if the program exits
+// successfully; each non-empty line it writes to stdout is added to the
+// discharge as a first-party caveat.
+type execChecker struct {
+	path string
+}
+
+func newExecChecker(ctx Context) (dischargeChecker, error) {
+	path := ctx.String("exec")
+	if path == "" {
+		return nil, fmt.Errorf("--exec is required for exec checker")
+	}
+	return &execChecker{path: path}, nil
+}
+
+func (c *execChecker) checkCondition(req *http.Request, condition string) ([]checkers.Caveat, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(c.path)
+	cmd.Env = append(os.Environ(), "OO_REMOTE_ADDR="+req.RemoteAddr)
+	cmd.Stdin = strings.NewReader(condition)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	var caveats []checkers.Caveat
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			caveats = append(caveats, checkers.Caveat{Condition: line})
+		}
+	}
+	return caveats, scanner.Err()
+}
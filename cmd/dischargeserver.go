@@ -0,0 +1,145 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+)
+
+type dischargeServerCommand struct{}
+
+// NewDischargeServerCommand returns a Command that serves discharges for
+// third-party caveats addressed to the client's key.
+func NewDischargeServerCommand() *dischargeServerCommand {
+	return &dischargeServerCommand{}
+}
+
+// CLICommand implements Command.
+func (c *dischargeServerCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "discharge-server",
+		Usage:  "serve discharges for third-party caveats",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name:  "listen",
+				Usage: "address to listen on",
+				Value: "127.0.0.1:8080",
+			},
+			cli.StringFlag{
+				Name:  "location",
+				Usage: "URL at which clients reach this service, if not http://<listen>",
+			},
+			cli.StringFlag{
+				Name:  "checker",
+				Usage: "how conditions are checked: allow, time, exec or totp",
+				Value: "allow",
+			},
+			cli.StringFlag{
+				Name:  "allow",
+				Usage: "comma-separated conditions discharged by the allow checker",
+			},
+			cli.StringFlag{
+				Name:  "not-before",
+				Usage: "RFC3339 start of time checker window",
+			},
+			cli.StringFlag{
+				Name:  "not-after",
+				Usage: "RFC3339 end of time checker window",
+			},
+			cli.StringFlag{
+				Name:  "exec",
+				Usage: "program run by the exec checker to check each condition",
+			},
+			cli.StringFlag{
+				Name:  "totp-ttl",
+				Usage: "how long the discharge for a valid TOTP code is valid",
+				Value: "1m",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *dischargeServerCommand) Do(ctx Context) error {
+	checker, err := newDischargeChecker(ctx)
+	if err != nil {
+		return err
+	}
+	rootPath := "/"
+	if ctx.String("checker") == "totp" {
+		// Clients recognize TOTP discharge services by their path.
+		rootPath = totpPath
+	}
+	handler, err := newDischargeHandler(ctx, rootPath, checker)
+	if err != nil {
+		return err
+	}
+	listen := ctx.String("listen")
+	log.Printf("listening for discharge requests on %s", listen)
+	return http.ListenAndServe(listen, handler)
+}
+
+// newDischargeHandler returns an http.ServeMux serving the httpbakery discharge
+// endpoints under rootPath, including publickey, with the client key.
+// Conditions are checked by checker, except those of client:encrypt caveats,
+// which the client key would decrypt; they are refused. Conditions are only
+// logged by digest.
+func newDischargeHandler(ctx Context, rootPath string, checker dischargeChecker) (*http.ServeMux, error) {
+	mgr := keyManager{ctx}
+	kp, err := mgr.keyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key: %v", err)
+	}
+	location := ctx.String("location")
+	if location == "" {
+		location = "http://" + ctx.String("listen") + strings.TrimSuffix(rootPath, "/")
+	}
+	svc, err := bakery.NewService(bakery.NewServiceParams{
+		Location: location,
+		Key:      kp.KeyPair,
+	})
+	if err != nil {
+		kp.wipe()
+		return nil, err
+	}
+	// The key pair is used for as long as the server runs.
+	mux := http.NewServeMux()
+	httpbakery.AddDischargeHandler(mux, rootPath, svc, func(req *http.Request, cavId, cav string) ([]checkers.Caveat, error) {
+		caveats, err := checkDischarge(checker, req, cav)
+		if err != nil {
+			log.Printf("%s: denied condition %s: %v", req.RemoteAddr, conditionID(cav), err)
+			return nil, err
+		}
+		log.Printf("%s: discharged condition %s", req.RemoteAddr, conditionID(cav))
+		return caveats, nil
+	})
+	return mux, nil
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/macaroon.v1"
+)
+
+// NewDischargeHandler exposes the discharge-server handler to tests, with the
+// checker given by --checker. The totp checker is served under /totp.
+func NewDischargeHandler(ctx Context) (http.Handler, error) {
+	checker, err := newDischargeChecker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rootPath := "/"
+	if ctx.String("checker") == "totp" {
+		rootPath = totpPath
+	}
+	return newDischargeHandler(ctx, rootPath, checker)
+}
+
+// NewDischargeChecker returns a function which checks conditions with the
+// checker given by --checker, as the discharge server does, returning the
+// conditions of the caveats it adds.
+func NewDischargeChecker(ctx Context) (func(req *http.Request, condition string) ([]string, error), error) {
+	checker, err := newDischargeChecker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return func(req *http.Request, condition string) ([]string, error) {
+		caveats, err := checkDischarge(checker, req, condition)
+		if err != nil {
+			return nil, err
+		}
+		var conds []string
+		for _, cav := range caveats {
+			conds = append(conds, cav.Condition)
+		}
+		return conds, nil
+	}, nil
+}
+
+// CheckDischarge checks a single condition with a new checker given by
+// --checker.
+func CheckDischarge(ctx Context, req *http.Request, condition string) ([]string, error) {
+	check, err := NewDischargeChecker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return check(req, condition)
+}
+
+// HOTPCode returns the RFC 4226 code for secret at counter.
+func HOTPCode(secret []byte, counter uint64) string {
+	return hotpCode(secret, counter)
+}
+
+// TOTPCode returns the RFC 6238 code for secret at t.
+func TOTPCode(secret []byte, t time.Time) string {
+	return hotpCode(secret, totpCounter(t))
+}
+
+// ApprovalQueue exposes the approve-server's queue to tests.
+type ApprovalQueue struct {
+	q *approvalQueue
+}
+
+// NewApprovalQueue returns a queue whose requests time out after timeout,
+// and whose grants expire after grantTTL.
+func NewApprovalQueue(timeout, grantTTL time.Duration) *ApprovalQueue {
+	return &ApprovalQueue{newApprovalQueue(timeout, grantTTL)}
+}
+
+// Check blocks until condition is granted, denied or times out, and returns
+// the conditions of the caveats added to a granted discharge.
+func (q *ApprovalQueue) Check(condition string) ([]string, error) {
+	caveats, err := q.q.checkCondition(&http.Request{RemoteAddr: "127.0.0.1:1234"}, condition)
+	var conds []string
+	for _, cav := range caveats {
+		conds = append(conds, cav.Condition)
+	}
+	return conds, err
+}
+
+// Handler returns the handler for oo approvals requests carrying token.
+func (q *ApprovalQueue) Handler(token string) http.Handler {
+	return q.q.serveApprovals(token)
+}
+
+// SecureBuffer exposes secure buffers to tests.
+type SecureBuffer struct {
+	*secureBuffer
+}
+
+// NewSecureBuffer returns a secure buffer of n zero bytes.
+func NewSecureBuffer(n int) SecureBuffer {
+	return SecureBuffer{newSecureBuffer(n)}
+}
+
+// ReadSecure reads r to EOF into a secure buffer.
+func ReadSecure(r io.Reader) (SecureBuffer, error) {
+	sb, err := readSecure(r)
+	return SecureBuffer{sb}, err
+}
+
+func (sb SecureBuffer) Grow(n int)      { sb.grow(n) }
+func (sb SecureBuffer) Truncate(n int)  { sb.truncate(n) }
+func (sb SecureBuffer) Cap() int        { return len(sb.mem) }
+func (sb SecureBuffer) Destroyed() bool { return sb.mem == nil }
+
+// VisitWebPage calls visitWebPage on a session in the given mode.
+func VisitWebPage(nonInteractive bool, u *url.URL) error {
+	s := &session{nonInteractive: nonInteractive}
+	return s.visitWebPage(u)
+}
+
+// DischargeCache exposes the discharge cache in OO_HOME to tests.
+type DischargeCache struct {
+	c *dischargeCache
+}
+
+func NewDischargeCache(ctx Context) (*DischargeCache, error) {
+	c, err := newDischargeCache(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &DischargeCache{c}, nil
+}
+
+func (c *DischargeCache) Get(caveatId string) *macaroon.Macaroon {
+	return c.c.get(caveatId)
+}
+
+func (c *DischargeCache) Put(caveatId string, m *macaroon.Macaroon) error {
+	return c.c.put(caveatId, m)
+}
+
+// ShardWorkers is the number of shards stored or fetched at once.
+const ShardWorkers = shardWorkers
+
+// UnmarshalAuth decodes an auth in any of the supported formats.
+func UnmarshalAuth(buf []byte) (macaroon.Slice, error) {
+	return unmarshalAuth(bytes.NewReader(buf))
+}
+
+// MarshalBinaryV2 encodes ms in the version 2 binary format.
+func MarshalBinaryV2(ms macaroon.Slice) ([]byte, error) {
+	return marshalBinaryV2(ms)
+}
+
+// MarshalJSONV2 encodes ms in the version 2 JSON format.
+func MarshalJSONV2(ms macaroon.Slice) ([]byte, error) {
+	return marshalJSONV2(ms)
+}
+
+// Compress compresses buf with the given algorithm, as new does with
+// --compress.
+func Compress(buf []byte, alg string) ([]byte, error) {
+	out, err := compress(buf, alg)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Destroy()
+	return append([]byte(nil), out.Bytes()...), nil
+}
+
+// Decompress decompresses buf with the given algorithm, expecting size bytes
+// of output, as fetch does for an envelope recording size.
+func Decompress(buf []byte, alg string, size int64) ([]byte, error) {
+	out, err := decompress(buf, alg, size)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Destroy()
+	return append([]byte(nil), out.Bytes()...), nil
+}
+
+// SealOverhead is the number of bytes sealing adds to padded contents.
+const SealOverhead = secretbox.Overhead
+
+// SetArchiveLimits sets the size and entry limits on extracting an archive,
+// returning a function which restores them.
+func SetArchiveLimits(size int64, entries int) (restore func()) {
+	oldSize, oldEntries := maxArchiveSize, maxArchiveEntries
+	maxArchiveSize, maxArchiveEntries = size, entries
+	return func() {
+		maxArchiveSize, maxArchiveEntries = oldSize, oldEntries
+	}
+}
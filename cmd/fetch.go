@@ -17,13 +17,13 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/codegangsta/cli"
 )
@@ -55,9 +55,43 @@ func (c *fetchCommand) CLICommand() cli.Command {
 			cli.StringFlag{
 				Name: "input, i",
 			},
+			cli.StringFlag{
+				Name:  "discharge-timeout",
+				Usage: "how long to wait for each third-party discharge",
+				Value: "10m",
+			},
+			cli.BoolFlag{
+				Name:  "browser",
+				Usage: "open web pages for interactive discharge in a browser",
+			},
+			cli.BoolFlag{
+				Name:  "non-interactive",
+				Usage: "fail if a discharge requires interaction",
+			},
+			cli.BoolFlag{
+				Name:  "no-discharge-cache",
+				Usage: "do not use or store cached discharges",
+			},
 			cli.StringFlag{
 				Name: "output, o",
 			},
+			cli.StringFlag{
+				Name:  "mode",
+				Usage: "permission mode of the --output file, in octal",
+				Value: "0600",
+			},
+			cli.BoolFlag{
+				Name:  "no-clobber",
+				Usage: "fail rather than replace an existing --output file",
+			},
+			cli.StringFlag{
+				Name:  "extract",
+				Usage: "extract an archived directory into the given directory",
+			},
+			cli.BoolFlag{
+				Name:  "restore",
+				Usage: "write to the original filename, mode and modification time",
+			},
 		},
 	}
 }
@@ -65,9 +99,8 @@ func (c *fetchCommand) CLICommand() cli.Command {
 // Do implements Command.
 func (c *fetchCommand) Do(ctx Context) error {
 	var (
-		input  io.ReadCloser
-		output io.WriteCloser
-		err    error
+		input io.ReadCloser
+		err   error
 	)
 
 	inputFile := ctx.String("input")
@@ -81,63 +114,106 @@ func (c *fetchCommand) Do(ctx Context) error {
 	}
 	defer input.Close()
 
+	extractDir := ctx.String("extract")
 	outputFile := ctx.String("output")
-	if outputFile == "" {
-		output = ctx.Stdout()
-	} else {
-		output, err = os.Create(outputFile)
-		if err != nil {
-			return fmt.Errorf("cannot create %q for output: %v", outputFile, err)
-		}
+	restore := ctx.Bool("restore")
+	if restore && (extractDir != "" || outputFile != "") {
+		return errors.New("--restore cannot be used with --extract or --output")
 	}
-	defer output.Close()
-
-	urlStr := ctx.String("url")
-	if urlStr == "" {
-		ctx.ShowAppHelp()
-		return errors.New("--url or OOSTORE_URL is required")
+	if extractDir != "" && outputFile != "" {
+		return errors.New("--extract and --output are mutually exclusive")
 	}
-
-	var authBuf bytes.Buffer
-	ms, err := unmarshalAuth(input)
+	mode, err := parseMode(ctx.String("mode"))
 	if err != nil {
 		return err
 	}
-	ms, env, err := dischargeAuth(ctx, ms)
+
+	s, err := newSession(ctx)
 	if err != nil {
 		return err
 	}
-	id, err := objectID(ms)
+	defer s.close()
+	authBuf, err := ioutil.ReadAll(input)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to read input: %v", err)
 	}
-	err = json.NewEncoder(&authBuf).Encode(ms)
+	contents, env, err := s.fetchAuth(authBuf)
 	if err != nil {
 		return err
 	}
-
-	req, err := http.NewRequest("POST", urlStr+"/"+id, bytes.NewBuffer(authBuf.Bytes()))
+	defer env.wipe()
+	defer destroyReader(contents)
+	if extractDir != "" {
+		if env == nil || !isArchive(env.contentType) {
+			return errors.New("cannot extract: object is not an archive")
+		}
+		return extractArchive(contents, env.contentType, extractDir)
+	}
+	if restore {
+		if env == nil {
+			return errors.New("cannot restore: object is not encrypted")
+		}
+		return restoreFile(contents, &env.metadata)
+	}
+	if outputFile == "" {
+		output := ctx.Stdout()
+		defer output.Close()
+		_, err = io.Copy(output, contents)
+		return err
+	}
+	// The output file only appears once the contents have been written in
+	// full, so a failed fetch leaves nothing behind.
+	err = writeFileAtomic(outputFile, mode, ctx.Bool("no-clobber"), func(w io.Writer) error {
+		_, err := io.Copy(w, contents)
+		return err
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create request %q: %v", urlStr, err)
+		return fmt.Errorf("cannot write %q: %v", outputFile, err)
 	}
+	return nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// parseMode parses a permission mode given in octal.
+func parseMode(s string) (os.FileMode, error) {
+	if s == "" {
+		return 0600, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid --mode %q, expected octal permissions such as 0600", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// restoreFile writes contents to the current directory under the filename
+// recorded in meta, with its mode and modification time. An existing file is
+// not overwritten.
+func restoreFile(contents io.Reader, meta *metadata) error {
+	name := filepath.Base(meta.filename)
+	if meta.filename == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+		return errors.New("cannot restore: object has no filename")
+	}
+	mode := meta.mode
+	if mode == 0 {
+		mode = 0600
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return fmt.Errorf("cannot restore: %v", err)
+	}
+	// The mode given to OpenFile is subject to umask.
+	err = f.Chmod(mode)
+	if err == nil {
+		_, err = io.Copy(f, contents)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return fmt.Errorf("error requesting %q: %v", urlStr, err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		var contents io.Reader
-		if env != nil {
-			contents, err = env.decrypt(resp.Body)
-			if err != nil {
-				return fmt.Errorf("error decrypting contents: %v", err)
-			}
-		} else {
-			contents = resp.Body
-		}
-		_, err = io.Copy(output, contents)
 		return err
 	}
-	return errHTTPResponse(resp)
+	if !meta.modTime.IsZero() {
+		return os.Chtimes(name, meta.modTime, meta.modTime)
+	}
+	return nil
 }
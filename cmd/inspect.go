@@ -0,0 +1,155 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+type inspectCommand struct{}
+
+// NewInspectCommand returns a Command that shows the metadata of an opaque
+// object.
+func NewInspectCommand() *inspectCommand {
+	return &inspectCommand{}
+}
+
+// CLICommand implements Command.
+func (c *inspectCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "inspect",
+		Usage:  "show metadata of opaque object and verify its contents",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "url",
+				EnvVar: "OOSTORE_URL",
+				Value:  defaultURL,
+			},
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name: "input, i",
+			},
+			cli.StringFlag{
+				Name:  "discharge-timeout",
+				Usage: "how long to wait for each third-party discharge",
+				Value: "10m",
+			},
+			cli.BoolFlag{
+				Name:  "browser",
+				Usage: "open web pages for interactive discharge in a browser",
+			},
+			cli.BoolFlag{
+				Name:  "non-interactive",
+				Usage: "fail if a discharge requires interaction",
+			},
+			cli.BoolFlag{
+				Name:  "no-discharge-cache",
+				Usage: "do not use or store cached discharges",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *inspectCommand) Do(ctx Context) error {
+	var (
+		input io.ReadCloser
+		err   error
+	)
+
+	inputFile := ctx.String("input")
+	if inputFile == "" {
+		input = ctx.Stdin()
+	} else {
+		input, err = os.Open(inputFile)
+		if err != nil {
+			return fmt.Errorf("cannot open %q for input: %v", inputFile, err)
+		}
+	}
+	defer input.Close()
+
+	s, err := newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	authBuf, err := ioutil.ReadAll(input)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %v", err)
+	}
+	contents, env, err := s.fetchAuth(authBuf)
+	if err != nil {
+		return err
+	}
+	defer env.wipe()
+	defer destroyReader(contents)
+	if env == nil {
+		return errors.New("cannot inspect: object is not encrypted")
+	}
+	// The plaintext is only needed to check its digest and size, and is
+	// kept off the heap.
+	plaintext, err := readSecure(contents)
+	if err != nil {
+		return err
+	}
+	defer plaintext.Destroy()
+
+	out := ctx.Stdout()
+	if env.filename != "" {
+		fmt.Fprintf(out, "filename: %s\n", env.filename)
+	}
+	if env.contentType != "" {
+		fmt.Fprintf(out, "content-type: %s\n", env.contentType)
+	}
+	fmt.Fprintf(out, "size: %d\n", plaintext.Len())
+	if env.compression != "" {
+		fmt.Fprintf(out, "compression: %s\n", env.compression)
+	}
+	if env.padding != "" {
+		fmt.Fprintf(out, "padding: %s\n", env.padding)
+	}
+	if !env.modTime.IsZero() {
+		fmt.Fprintf(out, "modified: %s\n", env.modTime.Format(time.RFC3339))
+	}
+	if env.mode != 0 {
+		fmt.Fprintf(out, "mode: %s\n", env.mode)
+	}
+	digest := sha512.Sum384(plaintext.Bytes())
+	if digest != env.sha384 {
+		fmt.Fprintln(out, "sha384: MISMATCH")
+		return errors.New("contents do not match the envelope digest")
+	}
+	fmt.Fprintf(out, "sha384: %x verified\n", digest)
+	// Objects created before sizes were recorded have none.
+	if env.size != 0 && env.size != int64(plaintext.Len()) {
+		return fmt.Errorf("contents are %d bytes, envelope records %d", plaintext.Len(), env.size)
+	}
+	return nil
+}
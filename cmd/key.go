@@ -54,6 +54,7 @@ func (c *keyCommand) Do(ctx Context) error {
 	if err != nil {
 		return fmt.Errorf("failed to load key: %v", err)
 	}
-	_, err = fmt.Println(basen.Base58.EncodeToString(kp.Public.Key[:]))
+	defer kp.wipe()
+	_, err = fmt.Fprintln(ctx.Stdout(), basen.Base58.EncodeToString(kp.Public.Key[:]))
 	return err
 }
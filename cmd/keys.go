@@ -27,6 +27,8 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"time"
+	"unsafe"
 
 	"golang.org/x/crypto/nacl/secretbox"
 	"gopkg.in/macaroon-bakery.v1/bakery"
@@ -47,12 +49,19 @@ func init() {
 	}
 }
 
+// keyPair is the client's key pair. It is held in a secure buffer, apart from
+// the heap; a bakery.KeyPair contains no pointers, so it can live there.
 type keyPair struct {
 	*bakery.KeyPair
+	mem *secureBuffer
 }
 
 func newKeyPair() *keyPair {
-	return &keyPair{&bakery.KeyPair{}}
+	mem := newSecureBuffer(int(unsafe.Sizeof(bakery.KeyPair{})))
+	return &keyPair{
+		KeyPair: (*bakery.KeyPair)(unsafe.Pointer(&mem.Bytes()[0])),
+		mem:     mem,
+	}
 }
 
 func (kp *keyPair) load(keyPath string) error {
@@ -61,7 +70,24 @@ func (kp *keyPair) load(keyPath string) error {
 		return err
 	}
 	defer f.Close()
-	return json.NewDecoder(f).Decode(&kp.KeyPair)
+	buf, err := readSecure(f)
+	if err != nil {
+		return err
+	}
+	defer buf.Destroy()
+	// The JSON decoder still makes short-lived copies of the key on the
+	// heap while decoding.
+	return json.Unmarshal(buf.Bytes(), kp.KeyPair)
+}
+
+// wipe zeroes and releases the key pair. It cannot be used afterwards. It
+// may be called more than once.
+func (kp *keyPair) wipe() {
+	if kp == nil {
+		return
+	}
+	kp.mem.Destroy()
+	kp.KeyPair = nil
 }
 
 func (kp *keyPair) save(keyPath string) error {
@@ -104,15 +130,19 @@ func (m keyManager) keyPair() (*keyPair, error) {
 	} else if os.IsNotExist(err) {
 		bakeryKeyPair, err := bakery.GenerateKey()
 		if err != nil {
+			kp.wipe()
 			return nil, fmt.Errorf("failed to create new key pair: %v", err)
 		}
-		kp.KeyPair = bakeryKeyPair
+		*kp.KeyPair = *bakeryKeyPair
+		*bakeryKeyPair = bakery.KeyPair{}
 		err = kp.save(keyPath)
 		if err != nil {
+			kp.wipe()
 			return nil, fmt.Errorf("failed to save new key pair: %v", err)
 		}
 		return kp, nil
 	}
+	kp.wipe()
 	return nil, err
 }
 
@@ -120,36 +150,119 @@ type envelope struct {
 	nonce  *[24]byte
 	key    *[32]byte
 	sha384 [sha512.Size384]byte
+
+	// size is the length of the plaintext.
+	size int64
+
+	// compression is the algorithm the plaintext was compressed with before
+	// sealing, if any.
+	compression string
+
+	// padding is the padding scheme applied after compression, if any, and
+	// sealedSize the length of what was sealed before it was padded.
+	padding    string
+	sealedSize int64
+
+	// keyMem holds key, apart from the heap.
+	keyMem *secureBuffer
+
+	metadata
+}
+
+// metadata describes the input an object was created from. It is carried in
+// the envelope, so only recipients can read it.
+type metadata struct {
+	// contentType is the content type of the plaintext, if known.
+	contentType string
+
+	// filename is the base name of the input file, if the input was a file.
+	filename string
+
+	// modTime and mode are those of the input file.
+	modTime time.Time
+	mode    os.FileMode
+}
+
+// fileMetadata returns the metadata of the named input file.
+func fileMetadata(path string) (metadata, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return metadata{}, err
+	}
+	return metadata{
+		filename: fi.Name(),
+		modTime:  fi.ModTime(),
+		mode:     fi.Mode().Perm(),
+	}, nil
 }
 
 func newEnvelope() *envelope {
-	return &envelope{nonce: new([24]byte), key: new([32]byte)}
+	keyMem := newSecureBuffer(32)
+	return &envelope{nonce: new([24]byte), key: (*[32]byte)(keyMem.Bytes()), keyMem: keyMem}
 }
 
 func generateEnvelope() (*envelope, error) {
-	nonce := new([24]byte)
-	_, err := rand.Reader.Read(nonce[:])
-	if err != nil {
-		return nil, err
+	env := newEnvelope()
+	_, err := rand.Reader.Read(env.nonce[:])
+	if err == nil {
+		_, err = rand.Reader.Read(env.key[:])
 	}
-	key := new([32]byte)
-	_, err = rand.Reader.Read(key[:])
 	if err != nil {
+		env.wipe()
 		return nil, err
 	}
-	return &envelope{nonce: nonce, key: key}, nil
+	return env, nil
+}
+
+// wipe zeroes and releases the key material of e, once it is no longer
+// needed. The envelope cannot be used afterwards.
+func (e *envelope) wipe() {
+	if e == nil || e.keyMem == nil {
+		return
+	}
+	e.keyMem.Destroy()
+	e.key = nil
+	e.sha384 = [sha512.Size384]byte{}
+}
+
+// equal returns whether e and other seal the same contents with the same key.
+func (e *envelope) equal(other *envelope) bool {
+	return *e.nonce == *other.nonce && *e.key == *other.key && e.sha384 == other.sha384
+}
+
+type envelopeJSON struct {
+	Nonce, Key, SHA384 []byte
+	Size               int64       `json:",omitempty"`
+	Compression        string      `json:",omitempty"`
+	Padding            string      `json:",omitempty"`
+	SealedSize         int64       `json:",omitempty"`
+	ContentType        string      `json:",omitempty"`
+	Filename           string      `json:",omitempty"`
+	ModTime            *time.Time  `json:",omitempty"`
+	Mode               os.FileMode `json:",omitempty"`
 }
 
 func (e *envelope) MarshalJSON() ([]byte, error) {
-	return json.Marshal(struct {
-		Nonce, Key, SHA384 []byte
-	}{e.nonce[:], e.key[:], e.sha384[:]})
+	st := envelopeJSON{
+		Nonce:       e.nonce[:],
+		Key:         e.key[:],
+		SHA384:      e.sha384[:],
+		Size:        e.size,
+		Compression: e.compression,
+		Padding:     e.padding,
+		SealedSize:  e.sealedSize,
+		ContentType: e.contentType,
+		Filename:    e.filename,
+		Mode:        e.mode,
+	}
+	if !e.modTime.IsZero() {
+		st.ModTime = &e.modTime
+	}
+	return json.Marshal(st)
 }
 
 func (e *envelope) UnmarshalJSON(buf []byte) error {
-	var st struct {
-		Nonce, Key, SHA384 []byte
-	}
+	var st envelopeJSON
 	err := json.Unmarshal(buf, &st)
 	if err != nil {
 		return err
@@ -164,45 +277,115 @@ func (e *envelope) UnmarshalJSON(buf []byte) error {
 		return fmt.Errorf("invalid key length %d", len(st.Key))
 	}
 	copy(e.key[:], st.Key)
+	zero(st.Key)
 
 	if len(st.SHA384) != sha512.Size384 {
 		return fmt.Errorf("invalid digest length %d", len(st.SHA384))
 	}
 	copy(e.sha384[:], st.SHA384)
 
+	e.size = st.Size
+	e.compression = st.Compression
+	e.padding = st.Padding
+	e.sealedSize = st.SealedSize
+	e.contentType = st.ContentType
+	e.filename = st.Filename
+	if st.ModTime != nil {
+		e.modTime = *st.ModTime
+	}
+	e.mode = st.Mode.Perm()
 	return nil
 }
 
-func encrypt(r io.ReadCloser) (*envelope, io.ReadCloser, error) {
-	var contents bytes.Buffer
-	_, err := io.Copy(&contents, r)
+// sealOptions are options for encrypting contents.
+type sealOptions struct {
+	// compression is the algorithm to compress contents with before
+	// sealing, or empty for none.
+	compression string
+
+	// padding is the padding scheme to hide the length of contents with,
+	// or empty for none.
+	padding string
+}
+
+// encrypt reads contents from r and seals them in a new envelope. Plaintext
+// is held in secure buffers, which are destroyed once it is sealed.
+func encrypt(r io.ReadCloser, opts sealOptions) (*envelope, io.ReadCloser, error) {
+	contents, err := readSecure(r)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to read content: %v", err)
 	}
 	err = r.Close()
 	if err != nil {
+		contents.Destroy()
 		return nil, nil, fmt.Errorf("failed to close input: %v", err)
 	}
 
+	defer contents.Destroy()
+
 	digest := sha512.Sum384(contents.Bytes())
 	env, err := generateEnvelope()
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create envelope: %v", err)
 	}
 	env.sha384 = digest
-	out := secretbox.Seal(nil, contents.Bytes(), env.nonce, env.key)
-	// TODO: zeroize `contents`
+	env.size = int64(contents.Len())
+	plaintext := contents
+	if opts.compression != "" {
+		plaintext, err = compress(contents.Bytes(), opts.compression)
+		if err != nil {
+			env.wipe()
+			return nil, nil, fmt.Errorf("failed to compress content: %v", err)
+		}
+		defer plaintext.Destroy()
+		env.compression = opts.compression
+	}
+	if opts.padding != "" {
+		env.padding = opts.padding
+		env.sealedSize = int64(plaintext.Len())
+		err = pad(plaintext, opts.padding)
+		if err != nil {
+			env.wipe()
+			return nil, nil, err
+		}
+	}
+	out := secretbox.Seal(nil, plaintext.Bytes(), env.nonce, env.key)
 	return env, ioutil.NopCloser(bytes.NewBuffer(out)), nil
 }
 
+// decrypt opens the ciphertext read from r. The plaintext is returned in a
+// secure buffer, which is destroyed once it has been read.
 func (env *envelope) decrypt(r io.Reader) (io.Reader, error) {
 	buf, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	out, ok := secretbox.Open(nil, buf, env.nonce, env.key)
+	if len(buf) < secretbox.Overhead {
+		return nil, fmt.Errorf("decryption failed")
+	}
+	out := newSecureBuffer(len(buf) - secretbox.Overhead)
+	// Open appends to its first argument, which has room for the
+	// plaintext, so it is written in place.
+	_, ok := secretbox.Open(out.Bytes()[:0], buf, env.nonce, env.key)
 	if !ok {
+		out.Destroy()
 		return nil, fmt.Errorf("decryption failed")
 	}
-	return bytes.NewBuffer(out), nil
+	if env.padding != "" {
+		unpadded, err := unpad(out.Bytes(), env.sealedSize)
+		if err != nil {
+			out.Destroy()
+			return nil, err
+		}
+		out.truncate(len(unpadded))
+	}
+	if env.compression != "" {
+		compressed := out
+		out, err = decompress(compressed.Bytes(), env.compression, env.size)
+		compressed.Destroy()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
 }
@@ -0,0 +1,225 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon.v1"
+)
+
+// ledger records objects created with an expiry in OO_HOME, so that they can
+// be deleted from the service once they expire. oostore services do not
+// expire objects themselves.
+type ledger struct {
+	dir string
+}
+
+// ledgerEntry records an object which expires. Auth is the auth issued by
+// the service, attenuated to deletion only. It has no client:encrypt or
+// time-before caveat, so it can delete the object after the auths given out
+// for it have expired.
+type ledgerEntry struct {
+	URL     string         `json:"url"`
+	Expires time.Time      `json:"expires"`
+	Auth    macaroon.Slice `json:"auth"`
+}
+
+func newLedger(ctx Context) (*ledger, error) {
+	home, err := keyManager{ctx}.homeDir()
+	if err != nil {
+		return nil, err
+	}
+	return &ledger{dir: filepath.Join(home, "ledger")}, nil
+}
+
+// record adds an entry for the object authorized by ms, stored at urlStr,
+// which expires at the given time.
+func (l *ledger) record(urlStr string, ms macaroon.Slice, expires time.Time) error {
+	id, err := objectID(ms)
+	if err != nil {
+		return err
+	}
+	auth := macaroon.Slice{ms[0].Clone()}
+	err = addCaveats(auth, []string{"operation delete"})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(l.dir, 0700)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(urlStr + "/" + id))
+	path := filepath.Join(l.dir, hex.EncodeToString(sum[:]))
+	return writeFileAtomic(path, 0600, false, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(&ledgerEntry{URL: urlStr, Expires: expires, Auth: auth})
+	})
+}
+
+// expired returns the paths and entries of the objects which have expired.
+func (l *ledger) expired(now time.Time) ([]string, []*ledgerEntry, error) {
+	files, err := ioutil.ReadDir(l.dir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	var paths []string
+	var entries []*ledgerEntry
+	for _, fi := range files {
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(l.dir, fi.Name())
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		var entry ledgerEntry
+		err = json.Unmarshal(buf, &entry)
+		if err != nil || len(entry.Auth) == 0 {
+			log.Printf("skipping invalid ledger entry %q", path)
+			continue
+		}
+		if entry.Expires.After(now) {
+			continue
+		}
+		paths = append(paths, path)
+		entries = append(entries, &entry)
+	}
+	return paths, entries, nil
+}
+
+// expire makes the objects the session creates expire after ttl, recording
+// them in the ledger.
+func (s *session) expire(ctx Context, ttl time.Duration) error {
+	l, err := newLedger(ctx)
+	if err != nil {
+		return err
+	}
+	s.ledger = l
+	s.expires = time.Now().Add(ttl)
+	return nil
+}
+
+type gcCommand struct{}
+
+// NewGCCommand returns a Command that deletes expired objects recorded in
+// the ledger.
+func NewGCCommand() *gcCommand {
+	return &gcCommand{}
+}
+
+// CLICommand implements Command.
+func (c *gcCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "gc",
+		Usage:  "delete objects created with --ttl which have expired",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "url",
+				EnvVar: "OOSTORE_URL",
+				Value:  defaultURL,
+			},
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.BoolFlag{
+				Name:  "dry-run, n",
+				Usage: "list expired objects without deleting them",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *gcCommand) Do(ctx Context) error {
+	l, err := newLedger(ctx)
+	if err != nil {
+		return err
+	}
+	paths, entries, err := l.expired(time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to read ledger: %v", err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	s, err := newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	var failed int
+	for i, entry := range entries {
+		id, err := objectID(entry.Auth)
+		if err != nil {
+			log.Printf("skipping ledger entry %q: %v", paths[i], err)
+			continue
+		}
+		if ctx.Bool("dry-run") {
+			fmt.Fprintf(ctx.Stdout(), "%s/%s expired %s\n", entry.URL, id, entry.Expires.Format(time.RFC3339))
+			continue
+		}
+		err = gcObject(s.at(entry.URL), entry.Auth)
+		if err != nil {
+			log.Printf("failed to delete %s/%s: %v", entry.URL, id, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(ctx.Stdout(), "%s/%s deleted\n", entry.URL, id)
+		err = os.Remove(paths[i])
+		if err != nil {
+			log.Printf("failed to remove ledger entry: %v", err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d expired objects could not be deleted", failed, len(entries))
+	}
+	return nil
+}
+
+// gcObject deletes an expired object. An object which is already gone, as
+// when it was deleted with oo delete, counts as deleted.
+func gcObject(s *session, ms macaroon.Slice) error {
+	resp, err := s.request("DELETE", ms)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return errHTTPResponse(resp)
+}
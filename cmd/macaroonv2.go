@@ -0,0 +1,424 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/macaroon.v1"
+)
+
+// The macaroon library only reads and writes the version 1 formats. Newer
+// bakery services use version 2, a more compact binary format with different
+// JSON field names. Macaroons are converted between the versions through the
+// version 1 binary format, so that their signatures are carried over intact.
+
+// rawMacaroon holds the fields of a macaroon common to both versions.
+type rawMacaroon struct {
+	location string
+	id       []byte
+	caveats  []rawCaveat
+	sig      []byte
+}
+
+type rawCaveat struct {
+	location string
+	id       []byte
+	vid      []byte
+}
+
+// Field types of the version 2 binary format.
+const (
+	v2FieldEOS            = 0
+	v2FieldLocation       = 1
+	v2FieldIdentifier     = 2
+	v2FieldVerificationId = 4
+	v2FieldSignature      = 6
+)
+
+func sliceToRaw(ms macaroon.Slice) ([]*rawMacaroon, error) {
+	buf, err := ms.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return parseV1Binary(buf)
+}
+
+func rawToSlice(raws []*rawMacaroon) (macaroon.Slice, error) {
+	var buf []byte
+	for _, m := range raws {
+		var err error
+		buf, err = appendV1Binary(buf, m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var ms macaroon.Slice
+	err := ms.UnmarshalBinary(buf)
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// parseV1Binary parses a sequence of macaroons in the version 1 binary
+// format, a series of packets each prefixed by its length in 4 hex digits.
+func parseV1Binary(buf []byte) ([]*rawMacaroon, error) {
+	var raws []*rawMacaroon
+	var m *rawMacaroon
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, errors.New("truncated packet")
+		}
+		n, err := strconv.ParseUint(string(buf[:4]), 16, 16)
+		if err != nil || n < 7 || int(n) > len(buf) || buf[n-1] != '\n' {
+			return nil, errors.New("invalid packet")
+		}
+		packet := buf[4 : n-1]
+		buf = buf[n:]
+		i := bytes.IndexByte(packet, ' ')
+		if i < 0 {
+			return nil, errors.New("invalid packet")
+		}
+		key, val := string(packet[:i]), packet[i+1:]
+		if key == "location" {
+			m = &rawMacaroon{location: string(val)}
+			raws = append(raws, m)
+			continue
+		}
+		if m == nil {
+			return nil, errors.New("packet before location")
+		}
+		switch key {
+		case "identifier":
+			m.id = val
+		case "cid":
+			m.caveats = append(m.caveats, rawCaveat{id: val})
+		case "vid", "cl":
+			if len(m.caveats) == 0 {
+				return nil, fmt.Errorf("%s packet without caveat", key)
+			}
+			cav := &m.caveats[len(m.caveats)-1]
+			if key == "vid" {
+				cav.vid = val
+			} else {
+				cav.location = string(val)
+			}
+		case "signature":
+			m.sig = val
+		default:
+			return nil, fmt.Errorf("unknown packet %q", key)
+		}
+	}
+	return raws, nil
+}
+
+func appendV1Binary(buf []byte, m *rawMacaroon) ([]byte, error) {
+	var err error
+	appendPacket := func(key string, val []byte) {
+		n := 4 + len(key) + 1 + len(val) + 1
+		if n > 0xffff {
+			err = fmt.Errorf("%s too long for version 1 macaroon", key)
+			return
+		}
+		buf = append(buf, fmt.Sprintf("%04x", n)...)
+		buf = append(buf, key...)
+		buf = append(buf, ' ')
+		buf = append(buf, val...)
+		buf = append(buf, '\n')
+	}
+	appendPacket("location", []byte(m.location))
+	appendPacket("identifier", m.id)
+	for _, cav := range m.caveats {
+		appendPacket("cid", cav.id)
+		if len(cav.vid) > 0 {
+			appendPacket("vid", cav.vid)
+		}
+		if cav.location != "" {
+			appendPacket("cl", []byte(cav.location))
+		}
+	}
+	appendPacket("signature", m.sig)
+	return buf, err
+}
+
+// marshalBinaryV2 returns ms in the version 2 binary format.
+func marshalBinaryV2(ms macaroon.Slice) ([]byte, error) {
+	raws, err := sliceToRaw(ms)
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	appendField := func(fieldType int, val []byte) {
+		var n [binary.MaxVarintLen64]byte
+		buf = append(buf, byte(fieldType))
+		buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(val)))]...)
+		buf = append(buf, val...)
+	}
+	for _, m := range raws {
+		buf = append(buf, 2)
+		if m.location != "" {
+			appendField(v2FieldLocation, []byte(m.location))
+		}
+		appendField(v2FieldIdentifier, m.id)
+		buf = append(buf, v2FieldEOS)
+		for _, cav := range m.caveats {
+			if cav.location != "" {
+				appendField(v2FieldLocation, []byte(cav.location))
+			}
+			appendField(v2FieldIdentifier, cav.id)
+			if len(cav.vid) > 0 {
+				appendField(v2FieldVerificationId, cav.vid)
+			}
+			buf = append(buf, v2FieldEOS)
+		}
+		buf = append(buf, v2FieldEOS)
+		appendField(v2FieldSignature, m.sig)
+	}
+	return buf, nil
+}
+
+// unmarshalBinaryV2 parses a sequence of macaroons in the version 2 binary
+// format.
+func unmarshalBinaryV2(buf []byte) (macaroon.Slice, error) {
+	type field struct {
+		fieldType int
+		val       []byte
+	}
+	readField := func() (field, error) {
+		if len(buf) == 0 {
+			return field{}, errors.New("truncated macaroon")
+		}
+		f := field{fieldType: int(buf[0])}
+		buf = buf[1:]
+		if f.fieldType == v2FieldEOS {
+			return f, nil
+		}
+		n, nlen := binary.Uvarint(buf)
+		if nlen <= 0 || n > uint64(len(buf)-nlen) {
+			return field{}, errors.New("truncated macaroon")
+		}
+		f.val = buf[nlen : nlen+int(n)]
+		buf = buf[nlen+int(n):]
+		return f, nil
+	}
+	// readSection reads the fields of a section up to its end, in order.
+	readSection := func() ([]field, error) {
+		var fields []field
+		for {
+			f, err := readField()
+			if err != nil {
+				return nil, err
+			}
+			if f.fieldType == v2FieldEOS {
+				return fields, nil
+			}
+			if len(fields) > 0 && f.fieldType <= fields[len(fields)-1].fieldType {
+				return nil, errors.New("fields out of order")
+			}
+			fields = append(fields, f)
+		}
+	}
+
+	var raws []*rawMacaroon
+	for len(buf) > 0 {
+		if buf[0] != 2 {
+			return nil, fmt.Errorf("unsupported macaroon version %d", buf[0])
+		}
+		buf = buf[1:]
+		m := &rawMacaroon{}
+		fields, err := readSection()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range fields {
+			switch f.fieldType {
+			case v2FieldLocation:
+				m.location = string(f.val)
+			case v2FieldIdentifier:
+				m.id = f.val
+			default:
+				return nil, fmt.Errorf("unexpected field %d", f.fieldType)
+			}
+		}
+		for {
+			fields, err := readSection()
+			if err != nil {
+				return nil, err
+			}
+			if len(fields) == 0 {
+				break
+			}
+			var cav rawCaveat
+			for _, f := range fields {
+				switch f.fieldType {
+				case v2FieldLocation:
+					cav.location = string(f.val)
+				case v2FieldIdentifier:
+					cav.id = f.val
+				case v2FieldVerificationId:
+					cav.vid = f.val
+				default:
+					return nil, fmt.Errorf("unexpected caveat field %d", f.fieldType)
+				}
+			}
+			m.caveats = append(m.caveats, cav)
+		}
+		f, err := readField()
+		if err != nil {
+			return nil, err
+		}
+		if f.fieldType != v2FieldSignature {
+			return nil, errors.New("missing signature")
+		}
+		m.sig = f.val
+		raws = append(raws, m)
+	}
+	return rawToSlice(raws)
+}
+
+// macaroonJSONV2 is the version 2 JSON representation of a macaroon. Binary
+// values are in the fields suffixed 64, in base64.
+type macaroonJSONV2 struct {
+	Caveats      []caveatJSONV2 `json:"c,omitempty"`
+	Location     string         `json:"l,omitempty"`
+	Identifier   string         `json:"i,omitempty"`
+	Identifier64 string         `json:"i64,omitempty"`
+	Signature    string         `json:"s,omitempty"`
+	Signature64  string         `json:"s64,omitempty"`
+}
+
+type caveatJSONV2 struct {
+	CID      string `json:"i,omitempty"`
+	CID64    string `json:"i64,omitempty"`
+	VID      string `json:"v,omitempty"`
+	VID64    string `json:"v64,omitempty"`
+	Location string `json:"l,omitempty"`
+}
+
+// marshalJSONV2 returns ms as a JSON array of version 2 JSON macaroons.
+func marshalJSONV2(ms macaroon.Slice) ([]byte, error) {
+	raws, err := sliceToRaw(ms)
+	if err != nil {
+		return nil, err
+	}
+	jms := make([]macaroonJSONV2, len(raws))
+	for i, m := range raws {
+		jm := &jms[i]
+		jm.Location = m.location
+		jm.Identifier, jm.Identifier64 = jsonV2Bytes(m.id)
+		jm.Signature64 = base64.RawURLEncoding.EncodeToString(m.sig)
+		for _, cav := range m.caveats {
+			jc := caveatJSONV2{Location: cav.location}
+			jc.CID, jc.CID64 = jsonV2Bytes(cav.id)
+			if len(cav.vid) > 0 {
+				jc.VID64 = base64.RawURLEncoding.EncodeToString(cav.vid)
+			}
+			jm.Caveats = append(jm.Caveats, jc)
+		}
+	}
+	return json.Marshal(jms)
+}
+
+// jsonV2Bytes returns b as text if it is valid UTF-8, otherwise in base64.
+func jsonV2Bytes(b []byte) (text, b64 string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return "", base64.RawURLEncoding.EncodeToString(b)
+}
+
+// unmarshalJSON parses a JSON array of macaroons, each of which may be in
+// version 1 or version 2 JSON.
+func unmarshalJSON(buf []byte) (macaroon.Slice, error) {
+	var elems []json.RawMessage
+	err := json.Unmarshal(buf, &elems)
+	if err != nil {
+		return nil, err
+	}
+	var ms macaroon.Slice
+	for _, elem := range elems {
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(elem, &fields)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fields["signature"]; ok {
+			var m macaroon.Macaroon
+			err = json.Unmarshal(elem, &m)
+			if err != nil {
+				return nil, err
+			}
+			ms = append(ms, &m)
+			continue
+		}
+		var jm macaroonJSONV2
+		err = json.Unmarshal(elem, &jm)
+		if err != nil {
+			return nil, err
+		}
+		m, err := jm.toSlice()
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m...)
+	}
+	return ms, nil
+}
+
+func (jm *macaroonJSONV2) toSlice() (macaroon.Slice, error) {
+	m := &rawMacaroon{location: jm.Location}
+	var err error
+	if m.id, err = jsonV2Field(jm.Identifier, jm.Identifier64); err != nil {
+		return nil, fmt.Errorf("invalid identifier: %v", err)
+	}
+	if m.sig, err = jsonV2Field(jm.Signature, jm.Signature64); err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+	for _, jc := range jm.Caveats {
+		cav := rawCaveat{location: jc.Location}
+		if cav.id, err = jsonV2Field(jc.CID, jc.CID64); err != nil {
+			return nil, fmt.Errorf("invalid caveat identifier: %v", err)
+		}
+		if cav.vid, err = jsonV2Field(jc.VID, jc.VID64); err != nil {
+			return nil, fmt.Errorf("invalid verification id: %v", err)
+		}
+		m.caveats = append(m.caveats, cav)
+	}
+	return rawToSlice([]*rawMacaroon{m})
+}
+
+// jsonV2Field returns the value of a version 2 JSON field given as text or
+// as base64, in any of the standard or URL-safe alphabets, padded or not.
+func jsonV2Field(text, b64 string) ([]byte, error) {
+	if b64 == "" {
+		return []byte(text), nil
+	}
+	b64 = strings.TrimRight(b64, "=")
+	if strings.ContainsAny(b64, "+/") {
+		return base64.RawStdEncoding.DecodeString(b64)
+	}
+	return base64.RawURLEncoding.DecodeString(b64)
+}
@@ -17,18 +17,20 @@
 package cmd
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 	"gopkg.in/basen.v1"
 	"gopkg.in/macaroon-bakery.v1/bakery"
-	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
 	"gopkg.in/macaroon.v1"
 )
 
@@ -59,14 +61,79 @@ func (c *newCommand) CLICommand() cli.Command {
 			cli.StringFlag{
 				Name: "input, i",
 			},
+			cli.BoolFlag{
+				Name:  "prompt",
+				Usage: "read the secret from the terminal, without echo",
+			},
+			cli.BoolFlag{
+				Name:  "confirm",
+				Usage: "with --prompt, enter the secret twice",
+			},
+			cli.BoolFlag{
+				Name:  "multiline",
+				Usage: "with --prompt, read lines until Ctrl-D",
+			},
 			cli.StringFlag{
 				Name: "output, o",
 			},
+			cli.StringFlag{
+				Name:   "auth-format",
+				EnvVar: "OO_AUTH_FORMAT",
+				Usage:  "auth output format: json, b64, armor or binary",
+				Value:  "json",
+			},
+			cli.StringFlag{
+				Name:   "macaroon-version",
+				EnvVar: "OO_MACAROON_VERSION",
+				Usage:  "macaroon serialization version of output auths: 1 or 2",
+				Value:  "1",
+			},
 			cli.StringFlag{
 				Name: "content-type",
 			},
 			cli.StringFlag{
-				Name: "to, t",
+				Name:  "to, t",
+				Usage: "recipient, or comma-separated recipients with --split",
+			},
+			cli.StringFlag{
+				Name:  "split",
+				Usage: "split into k-of-n secret shares, one per recipient, output to a directory",
+			},
+			cli.StringFlag{
+				Name:  "dir",
+				Usage: "archive the contents of a directory as the object",
+			},
+			cli.StringFlag{
+				Name:  "archive-format",
+				Usage: "archive format for --dir: tar, tar.gz or tar.zst",
+				Value: "tar",
+			},
+			cli.StringFlag{
+				Name:  "escrow",
+				Usage: "also seal the object to this escrow recipient, for recovery",
+			},
+			cli.StringFlag{
+				Name:  "escrow-output",
+				Usage: "file to write the escrow auth to",
+			},
+			cli.StringFlag{
+				Name:   "shard-size",
+				EnvVar: "OO_SHARD_SIZE",
+				Usage:  "split objects larger than this many bytes into shards",
+			},
+			cli.StringFlag{
+				Name:   "compress",
+				EnvVar: "OO_COMPRESS",
+				Usage:  "compress contents before encrypting: zstd or gzip",
+			},
+			cli.StringFlag{
+				Name:  "ttl",
+				Usage: "expire the object after this long, such as 24h or 7d, for oo gc to delete",
+			},
+			cli.StringFlag{
+				Name:   "pad",
+				EnvVar: "OO_PAD",
+				Usage:  "hide the length of contents: pow2, or a block size in bytes",
 			},
 		},
 	}
@@ -75,127 +142,255 @@ func (c *newCommand) CLICommand() cli.Command {
 // Do implements Command.
 func (c *newCommand) Do(ctx Context) error {
 	var (
-		input  io.ReadCloser
-		output io.WriteCloser
-		err    error
+		input io.ReadCloser
+		err   error
 	)
 
+	format, err := authFormat(ctx)
+	if err != nil {
+		return err
+	}
+
+	compression, err := parseCompression(ctx.String("compress"))
+	if err != nil {
+		return err
+	}
+	padding, err := parsePadding(ctx.String("pad"))
+	if err != nil {
+		return err
+	}
+	var ttl time.Duration
+	if ttlStr := ctx.String("ttl"); ttlStr != "" {
+		ttl, err = parseDuration(ttlStr)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid --ttl %q", ttlStr)
+		}
+	}
+
+	var shardSize int
+	if shardSizeStr := ctx.String("shard-size"); shardSizeStr != "" {
+		shardSize, err = strconv.Atoi(shardSizeStr)
+		if err != nil || shardSize < 0 {
+			return fmt.Errorf("invalid --shard-size %q", shardSizeStr)
+		}
+	}
+
+	var splitK, splitN int
+	if split := ctx.String("split"); split != "" {
+		splitK, splitN, err = parseSplit(split)
+		if err != nil {
+			return err
+		}
+		if ctx.String("output") == "" {
+			return errors.New("--output directory is required with --split")
+		}
+		if shardSize > 0 || ctx.String("escrow") != "" {
+			return errors.New("--split cannot be used with --shard-size or --escrow")
+		}
+		if compression != "" {
+			return errors.New("--split cannot be used with --compress")
+		}
+	}
+
+	escrowName, escrowFile := ctx.String("escrow"), ctx.String("escrow-output")
+	if escrowName != "" {
+		if escrowFile == "" {
+			return errors.New("--escrow-output is required with --escrow")
+		}
+		if shardSize > 0 {
+			return errors.New("--escrow cannot be used with --shard-size")
+		}
+	}
+
+	var meta metadata
 	inputFile := ctx.String("input")
-	if inputFile == "" {
+	inputDir := ctx.String("dir")
+	prompt := ctx.Bool("prompt")
+	if !prompt && (ctx.Bool("confirm") || ctx.Bool("multiline")) {
+		return errors.New("--confirm and --multiline require --prompt")
+	}
+	if prompt {
+		if inputFile != "" || inputDir != "" {
+			return errors.New("--prompt cannot be used with --input or --dir")
+		}
+		secret, err := promptSecret(ctx.Bool("confirm"), ctx.Bool("multiline"))
+		if err != nil {
+			return err
+		}
+		input = ioutil.NopCloser(secret)
+	} else if inputDir != "" {
+		if inputFile != "" {
+			return errors.New("--dir and --input are mutually exclusive")
+		}
+		input, meta.contentType, err = archiveDir(inputDir, ctx.String("archive-format"))
+		if err != nil {
+			return err
+		}
+	} else if inputFile == "" {
 		input = ctx.Stdin()
 	} else {
 		input, err = os.Open(inputFile)
 		if err != nil {
 			return fmt.Errorf("cannot open %q for input: %v", inputFile, err)
 		}
-	}
-	defer input.Close()
-
-	env, input, err := encrypt(input)
-
-	outputFile := ctx.String("output")
-	if outputFile == "" {
-		output = ctx.Stdout()
-	} else {
-		output, err = os.Create(outputFile)
+		meta, err = fileMetadata(inputFile)
 		if err != nil {
-			return fmt.Errorf("cannot create %q for output: %v", outputFile, err)
+			return err
 		}
 	}
-	defer output.Close()
+	if inputDir == "" {
+		meta.contentType = ctx.String("content-type")
+	}
+	defer input.Close()
 
-	urlStr := ctx.String("url")
-	if urlStr == "" {
-		ctx.ShowAppHelp()
-		return errors.New("--url or OOSTORE_URL is required")
+	if splitN > 0 {
+		return c.split(ctx, input, meta, splitK, splitN, format, padding, ttl)
 	}
 
-	req, err := http.NewRequest("POST", urlStr, input)
+	s, err := newSession(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create request %q: %v", urlStr, err)
+		return err
 	}
-
-	contentType := ctx.String("content-type")
-	if contentType != "" {
-		req.Header.Set("Content-Type", contentType)
+	defer s.close()
+	s.seal = sealOptions{compression: compression, padding: padding}
+	if ttl > 0 {
+		err = s.expire(ctx, ttl)
+		if err != nil {
+			return err
+		}
 	}
-
-	resp, err := http.DefaultClient.Do(req)
+	to, err := recipientKey(ctx, s.key)
 	if err != nil {
-		return fmt.Errorf("error requesting %q: %v", urlStr, err)
+		return err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		ms, err := unmarshalAuth(resp.Body)
+	if shardSize > 0 {
+		m, err := s.createSharded(input, meta, to, shardSize)
 		if err != nil {
-			return fmt.Errorf("invalid auth response: %v", err)
+			return err
 		}
-		err = newContext{ctx}.addThirdPartyCaveat(ms[0], env)
+		// The auth is only output once every shard is stored.
+		return writeCtxOutput(ctx, func(w io.Writer) error {
+			if len(m.Shards) == 1 {
+				return encodeAuth(w, m.Shards[0].Auth, format)
+			}
+			return json.NewEncoder(w).Encode(m)
+		})
+	}
+	// The escrow auth, if any, and the auth are written before the object
+	// is kept. If either can't be, the object is deleted rather than
+	// orphaned.
+	var escrow *bakery.PublicKey
+	if escrowName != "" {
+		escrow, err = parseRecipient(ctx, escrowName)
 		if err != nil {
-			return fmt.Errorf("failed to add third-party caveat: %v", err)
+			return fmt.Errorf("invalid --escrow: %v", err)
 		}
-		err = json.NewEncoder(output).Encode(ms)
-		return err
 	}
-	return errHTTPResponse(resp)
-}
-
-type newContext struct {
-	Context
+	return s.createEscrowed(input, meta, to, escrow, func(ms, escrowAuth macaroon.Slice) error {
+		if escrow != nil {
+			err := writeFileAtomic(escrowFile, 0600, false, func(w io.Writer) error {
+				return encodeAuth(w, escrowAuth, format)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to write escrow auth: %v", err)
+			}
+		}
+		err := writeCtxOutput(ctx, func(w io.Writer) error {
+			return encodeAuth(w, ms, format)
+		})
+		if err != nil && escrow != nil {
+			os.Remove(escrowFile)
+		}
+		return err
+	})
 }
 
-func (ctx newContext) addThirdPartyCaveat(m *macaroon.Macaroon, env *envelope) error {
-	condition, err := env.MarshalJSON()
-	if err != nil {
-		return err
+// split stores input as n secret shares, any k of which reconstruct it, and
+// writes their auths to the --output directory.
+func (c *newCommand) split(ctx Context, input io.Reader, meta metadata, k, n int, format authEncoding, padding string, ttl time.Duration) error {
+	names := strings.Split(ctx.String("to"), ",")
+	if len(names) != n || ctx.String("to") == "" {
+		return fmt.Errorf("--split %d-of-%d needs %d comma-separated --to recipients", k, n, n)
+	}
+	var recipients []*bakery.PublicKey
+	for _, name := range names {
+		to, err := parseRecipient(ctx, strings.TrimSpace(name))
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, to)
 	}
-	mgr := keyManager{ctx.Context}
-	kp, err := mgr.keyPair()
+	s, err := newSession(ctx)
 	if err != nil {
 		return err
 	}
-	agent, err := bakery.NewService(bakery.NewServiceParams{
-		Key:     kp.KeyPair,
-		Locator: clientLocator{ctx.Context, kp},
-	})
+	defer s.close()
+	s.seal.padding = padding
+	if ttl > 0 {
+		err = s.expire(ctx, ttl)
+		if err != nil {
+			return err
+		}
+	}
+	auths, err := s.createSplit(input, meta, recipients, k)
 	if err != nil {
 		return err
 	}
-	return agent.AddCaveat(m, checkers.Caveat{Location: "client:encrypt", Condition: string(condition)})
+	return writeSplitAuths(ctx.String("output"), auths, format)
 }
 
-type clientLocator struct {
-	ctx   Context
-	local *keyPair
+// recipientKey returns the public key of the recipient given with --to, or
+// the client's own public key if no recipient was given.
+func recipientKey(ctx Context, local *keyPair) (*bakery.PublicKey, error) {
+	to := ctx.String("to")
+	if to == "" {
+		return &local.Public, nil
+	}
+	return parseRecipient(ctx, to)
 }
 
-// PublicKeyForLocation implements bakery.PublicKeyLocator by providing the
-// same initialized key every time.
-// TODO: support multiple key identities, getting key from command line or something.
-func (l clientLocator) PublicKeyForLocation(loc string) (*bakery.PublicKey, error) {
-	to := l.ctx.String("to")
-	if to != "" {
-		toBytes, err := basen.Base58.DecodeString(to)
-		if err != nil {
-			return nil, err
-		}
-		var key bakery.PublicKey
-		copy(key.Key[:], toBytes)
-		return &key, nil
+// parseRecipient returns the public key of a recipient given as a
+// base58-encoded public key, or the name of a contact in $OO_HOME/contacts
+// whose file contains one.
+func parseRecipient(ctx Context, name string) (*bakery.PublicKey, error) {
+	encoded := name
+	if contact, err := contactKey(ctx, name); err == nil {
+		encoded = contact
+	} else if !os.IsNotExist(err) {
+		return nil, err
 	}
-	return &l.local.Public, nil
+	var key bakery.PublicKey
+	keyBytes, err := basen.Base58.DecodeString(encoded)
+	if err != nil || len(keyBytes) != len(key.Key) {
+		return nil, fmt.Errorf("invalid recipient %q: not a contact or public key", name)
+	}
+	copy(key.Key[:], keyBytes)
+	return &key, nil
 }
 
-func unmarshalAuth(r io.Reader) (macaroon.Slice, error) {
-	var mjson bytes.Buffer
-	_, err := io.Copy(&mjson, r)
+// contactKey returns the base58-encoded public key stored for a named
+// contact.
+func contactKey(ctx Context, name string) (string, error) {
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", os.ErrNotExist
+	}
+	home, err := keyManager{ctx}.homeDir()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read input: %v", err)
+		return "", err
 	}
-	var ms macaroon.Slice
-	err = json.Unmarshal(mjson.Bytes(), &ms)
+	buf, err := ioutil.ReadFile(filepath.Join(home, "contacts", name))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode auth: %v", err)
+		return "", err
 	}
-	return ms, nil
+	return strings.TrimSpace(string(buf)), nil
+}
+
+type clientLocator struct {
+	to *bakery.PublicKey
+}
+
+// PublicKeyForLocation implements bakery.PublicKeyLocator by providing the
+// recipient key every time.
+func (l clientLocator) PublicKeyForLocation(loc string) (*bakery.PublicKey, error) {
+	return l.to, nil
 }
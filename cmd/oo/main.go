@@ -42,6 +42,20 @@ func main() {
 		cmd.NewCondCommand().CLICommand(),
 		cmd.NewDeleteCommand().CLICommand(),
 		cmd.NewKeyCommand().CLICommand(),
+		cmd.NewRotateCommand().CLICommand(),
+		cmd.NewCopyCommand().CLICommand(),
+		cmd.NewBatchCommand().CLICommand(),
+		cmd.NewDischargeServerCommand().CLICommand(),
+		cmd.NewApproveServerCommand().CLICommand(),
+		cmd.NewApprovalsCommand().CLICommand(),
+		cmd.NewTOTPEnrollCommand().CLICommand(),
+		cmd.NewCacheCommand().CLICommand(),
+		cmd.NewDischargeCommand().CLICommand(),
+		cmd.NewShareCommand().CLICommand(),
+		cmd.NewRecoverCommand().CLICommand(),
+		cmd.NewCombineCommand().CLICommand(),
+		cmd.NewInspectCommand().CLICommand(),
+		cmd.NewGCCommand().CLICommand(),
 	}
 	app.Run(os.Args)
 }
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// padPow2 pads contents to the next power of two, of at least minPadBucket
+// bytes. Other padding schemes are a block size in bytes, which contents are
+// padded to a multiple of.
+const padPow2 = "pow2"
+
+// minPadBucket is the smallest size contents are padded to with padPow2, so
+// that short secrets all look alike.
+const minPadBucket = 256
+
+// maxPadBlock bounds the block size given to --pad.
+const maxPadBlock = 1 << 24
+
+// parsePadding checks a --pad scheme.
+func parsePadding(padding string) (string, error) {
+	if padding == "" || padding == padPow2 {
+		return padding, nil
+	}
+	block, err := strconv.Atoi(padding)
+	if err != nil || block < 1 || block > maxPadBlock {
+		return "", fmt.Errorf("invalid --pad %q, expected pow2 or a block size of 1 to %d bytes", padding, maxPadBlock)
+	}
+	return strconv.Itoa(block), nil
+}
+
+// paddedSize returns the length n bytes are padded to with the given scheme.
+func paddedSize(n int, padding string) (int, error) {
+	if padding == padPow2 {
+		size := minPadBucket
+		for size < n {
+			size <<= 1
+			if size <= 0 {
+				return 0, errors.New("contents too large to pad")
+			}
+		}
+		return size, nil
+	}
+	block, err := strconv.Atoi(padding)
+	if err != nil || block < 1 {
+		return 0, fmt.Errorf("unsupported padding %q", padding)
+	}
+	if n == 0 {
+		return block, nil
+	}
+	return (n + block - 1) / block * block, nil
+}
+
+// pad appends zeros to the contents of sb, to the length given by the
+// padding scheme.
+func pad(sb *secureBuffer, padding string) error {
+	size, err := paddedSize(sb.Len(), padding)
+	if err != nil {
+		return err
+	}
+	_, err = sb.Write(make([]byte, size-sb.Len()))
+	return err
+}
+
+// unpad returns the first n bytes of buf, after checking that the rest is
+// padding.
+func unpad(buf []byte, n int64) ([]byte, error) {
+	if n < 0 || n > int64(len(buf)) {
+		return nil, fmt.Errorf("invalid padding: %d bytes of contents in %d", n, len(buf))
+	}
+	for _, b := range buf[n:] {
+		if b != 0 {
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return buf[:n], nil
+}
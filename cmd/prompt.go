@@ -0,0 +1,94 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// errNoTTY is returned when a secret is to be prompted for, but there is no
+// terminal to prompt on.
+var errNoTTY = errors.New("--prompt requires a terminal; pipe the secret to stdin or use --input instead")
+
+// promptSecret reads a secret from the controlling terminal, without echo.
+// A single line is read, without its newline, unless multiline is set, in
+// which case lines are read until Ctrl-D. If confirm is set, the secret must
+// be entered twice.
+func promptSecret(confirm, multiline bool) (*secureBuffer, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errNoTTY
+	}
+	defer tty.Close()
+	if !terminal.IsTerminal(int(tty.Fd())) {
+		return nil, errNoTTY
+	}
+
+	prompt := "Secret: "
+	if multiline {
+		prompt = "Secret, ending with Ctrl-D:\n"
+	}
+	secret, err := readSecret(tty, prompt, multiline)
+	if err != nil || !confirm {
+		return secret, err
+	}
+	again, err := readSecret(tty, "Confirm: ", multiline)
+	if err != nil {
+		secret.Destroy()
+		return nil, err
+	}
+	defer again.Destroy()
+	if subtle.ConstantTimeCompare(secret.Bytes(), again.Bytes()) != 1 {
+		secret.Destroy()
+		return nil, errors.New("secrets do not match")
+	}
+	return secret, nil
+}
+
+// readSecret writes prompt to tty and reads a secret from it, without echo.
+func readSecret(tty *os.File, prompt string, multiline bool) (*secureBuffer, error) {
+	_, err := fmt.Fprint(tty, prompt)
+	if err != nil {
+		return nil, err
+	}
+	secret := newSecureBuffer(0)
+	for {
+		line, err := terminal.ReadPassword(int(tty.Fd()))
+		if err == io.EOF && multiline {
+			break
+		} else if err != nil {
+			zero(line)
+			secret.Destroy()
+			return nil, fmt.Errorf("cannot read secret: %v", err)
+		}
+		secret.Write(line)
+		zero(line)
+		if !multiline {
+			break
+		}
+		secret.Write([]byte("\n"))
+	}
+	// Echo is off, so the newline which ended input wasn't shown.
+	fmt.Fprintln(tty)
+	return secret, nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/codegangsta/cli"
+)
+
+type recoverCommand struct{}
+
+// NewRecoverCommand returns a Command that turns an escrow auth into an auth
+// for a replacement identity.
+func NewRecoverCommand() *recoverCommand {
+	return &recoverCommand{}
+}
+
+// CLICommand implements Command.
+func (c *recoverCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "recover",
+		Usage:  "re-address escrow auth to a replacement identity, run with the escrow key",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name: "input, i",
+			},
+			cli.StringFlag{
+				Name: "output, o",
+			},
+			cli.StringFlag{
+				Name:   "auth-format",
+				EnvVar: "OO_AUTH_FORMAT",
+				Usage:  "auth output format: json, b64, armor or binary",
+				Value:  "json",
+			},
+			cli.StringFlag{
+				Name:   "macaroon-version",
+				EnvVar: "OO_MACAROON_VERSION",
+				Usage:  "macaroon serialization version of output auths: 1 or 2",
+				Value:  "1",
+			},
+			cli.StringFlag{
+				Name:  "to, t",
+				Usage: "replacement identity contact name or base58 public key",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *recoverCommand) Do(ctx Context) error {
+	if ctx.String("to") == "" {
+		ctx.ShowAppHelp()
+		return errors.New("--to is required")
+	}
+	kp, err := keyManager{ctx}.keyPair()
+	if err != nil {
+		return fmt.Errorf("failed to load key: %v", err)
+	}
+	defer kp.wipe()
+	to, err := recipientKey(ctx, kp)
+	if err != nil {
+		return err
+	}
+	ms, err := readInputAuth(ctx)
+	if err != nil {
+		return err
+	}
+	// Recovery is sharing, from the escrow key to the replacement, without
+	// attenuation.
+	ms, err = share(ms, kp, to, nil)
+	if err != nil {
+		return fmt.Errorf("cannot recover: %v", err)
+	}
+	return writeAuth(ctx, ms)
+}
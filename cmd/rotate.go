@@ -0,0 +1,219 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon.v1"
+)
+
+type rotateCommand struct{}
+
+// NewRotateCommand returns a Command that re-encrypts an opaque object into a
+// new object and deletes the original.
+func NewRotateCommand() *rotateCommand {
+	return &rotateCommand{}
+}
+
+// CLICommand implements Command.
+func (c *rotateCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "rotate",
+		Usage:  "re-encrypt opaque object into a new object, delete the original",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "url",
+				EnvVar: "OOSTORE_URL",
+				Value:  defaultURL,
+			},
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name: "input, i",
+			},
+			cli.StringFlag{
+				Name: "output, o",
+			},
+			cli.StringFlag{
+				Name:   "auth-format",
+				EnvVar: "OO_AUTH_FORMAT",
+				Usage:  "auth output format: json, b64, armor or binary",
+				Value:  "json",
+			},
+			cli.StringFlag{
+				Name:   "macaroon-version",
+				EnvVar: "OO_MACAROON_VERSION",
+				Usage:  "macaroon serialization version of output auths: 1 or 2",
+				Value:  "1",
+			},
+			cli.StringFlag{
+				Name: "to, t",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *rotateCommand) Do(ctx Context) error {
+	var (
+		input io.ReadCloser
+		err   error
+	)
+
+	inputFile := ctx.String("input")
+	if inputFile == "" {
+		input = ctx.Stdin()
+	} else {
+		input, err = os.Open(inputFile)
+		if err != nil {
+			return fmt.Errorf("cannot open %q for input: %v", inputFile, err)
+		}
+	}
+	defer input.Close()
+
+	format, err := authFormat(ctx)
+	if err != nil {
+		return err
+	}
+	s, err := newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	to, err := recipientKey(ctx, s.key)
+	if err != nil {
+		return err
+	}
+	oldAuth, err := unmarshalAuth(input)
+	if err != nil {
+		return err
+	}
+	// The new auth is written before the original object is deleted, and
+	// output files are replaced atomically, so that a failure never leaves
+	// us without a working auth.
+	outputFile := ctx.String("output")
+	return s.rotate(oldAuth, to, func(newAuth macaroon.Slice) error {
+		if outputFile == "" {
+			output := ctx.Stdout()
+			defer output.Close()
+			return encodeAuth(output, newAuth, format)
+		}
+		err := writeFileAtomic(outputFile, 0600, false, func(w io.Writer) error {
+			return encodeAuth(w, newAuth, format)
+		})
+		if err != nil {
+			return fmt.Errorf("cannot write %q for output: %v", outputFile, err)
+		}
+		return nil
+	})
+}
+
+// rotate replaces the object authorized by oldAuth with a new object holding
+// the same contents under a fresh envelope, addressed to the given recipient.
+// The new object is read back and verified, and its auth passed to write,
+// before the original is deleted. If any of these steps fail, the new object
+// is deleted and the original is left in place.
+func (s *session) rotate(oldAuth macaroon.Slice, to *bakery.PublicKey, write func(macaroon.Slice) error) error {
+	oldAuth, oldEnv, err := s.discharge(oldAuth)
+	if err != nil {
+		return fmt.Errorf("failed to discharge auth: %v", err)
+	}
+	defer oldEnv.wipe()
+	if oldEnv == nil {
+		return fmt.Errorf("cannot rotate: auth has no decryption envelope")
+	}
+	body, err := s.fetchObject(oldAuth)
+	if err != nil {
+		return fmt.Errorf("failed to fetch object: %v", err)
+	}
+	contents, err := oldEnv.decrypt(body)
+	body.Close()
+	if err != nil {
+		return fmt.Errorf("error decrypting contents: %v", err)
+	}
+
+	env, ciphertext, err := encrypt(ioutil.NopCloser(contents), sealOptions{compression: oldEnv.compression, padding: oldEnv.padding})
+	if err != nil {
+		return err
+	}
+	defer env.wipe()
+	env.metadata = oldEnv.metadata
+	newAuth, err := s.newObject(ciphertext, "")
+	if err != nil {
+		return fmt.Errorf("failed to create new object: %v", err)
+	}
+
+	// The new object is verified with the auth issued by the service, before
+	// the client:encrypt caveat is added to a copy of it. The recipient may
+	// not be us, in which case we could not discharge it.
+	err = s.verify(newAuth, env)
+	var m *macaroon.Macaroon
+	if err == nil {
+		m = newAuth[0].Clone()
+		err = s.addEncryptCaveat(m, env, to)
+	}
+	if err == nil {
+		err = write(append(macaroon.Slice{m}, newAuth[1:]...))
+	}
+	if err != nil {
+		if rbErr := s.deleteObject(newAuth); rbErr != nil {
+			log.Printf("failed to roll back new object: %v", rbErr)
+		}
+		return fmt.Errorf("rotation failed: %v", err)
+	}
+	err = s.deleteObject(oldAuth)
+	if err != nil {
+		return fmt.Errorf("rotated, but failed to delete original: %v", err)
+	}
+	return nil
+}
+
+// verify fetches the object authorized by ms and checks that it decrypts to
+// the contents sealed in env.
+func (s *session) verify(ms macaroon.Slice, env *envelope) error {
+	body, err := s.fetchObject(ms)
+	if err != nil {
+		return fmt.Errorf("failed to fetch new object: %v", err)
+	}
+	defer body.Close()
+	contents, err := env.decrypt(body)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt new object: %v", err)
+	}
+	// Reading one secure buffer into another leaves no copy on the heap.
+	plaintext, err := readSecure(contents)
+	if err != nil {
+		return err
+	}
+	defer plaintext.Destroy()
+	if sha512.Sum384(plaintext.Bytes()) != env.sha384 {
+		return fmt.Errorf("new object contents do not match")
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"io"
+)
+
+// secureBuffer holds secret bytes, such as plaintext and keys, outside of the
+// garbage-collected heap. Where the platform allows, its memory is locked so
+// that it is not swapped to disk. Destroy zeroes and releases it.
+type secureBuffer struct {
+	// mem is the whole allocation, and buf the contents, a prefix of mem.
+	mem, buf []byte
+	mapped   bool
+
+	// off is the offset of the next Read.
+	off int
+}
+
+// newSecureBuffer returns a secure buffer of n zero bytes.
+func newSecureBuffer(n int) *secureBuffer {
+	mem, mapped := allocSecure(n)
+	return &secureBuffer{mem: mem, buf: mem[:n], mapped: mapped}
+}
+
+// readSecure reads r to EOF into a secure buffer.
+func readSecure(r io.Reader) (*secureBuffer, error) {
+	sb := newSecureBuffer(0)
+	for {
+		sb.grow(1)
+		n, err := r.Read(sb.mem[len(sb.buf):])
+		sb.buf = sb.mem[:len(sb.buf)+n]
+		if err == io.EOF {
+			return sb, nil
+		} else if err != nil {
+			sb.Destroy()
+			return nil, err
+		}
+	}
+}
+
+// grow makes room for at least n more bytes of contents. The buffer grows
+// into a new secure allocation, and the outgrown one is destroyed, so no copy
+// of the contents is left behind.
+func (sb *secureBuffer) grow(n int) {
+	if len(sb.mem)-len(sb.buf) >= n {
+		return
+	}
+	size := 2*len(sb.mem) + 4096
+	if size < len(sb.buf)+n {
+		size = len(sb.buf) + n
+	}
+	next := newSecureBuffer(size)
+	next.buf = next.mem[:copy(next.mem, sb.buf)]
+	sb.Destroy()
+	*sb = *next
+}
+
+// Write implements io.Writer, appending p to the contents.
+func (sb *secureBuffer) Write(p []byte) (int, error) {
+	sb.grow(len(p))
+	n := len(sb.buf)
+	sb.buf = sb.mem[:n+len(p)]
+	return copy(sb.buf[n:], p), nil
+}
+
+// Bytes returns the contents of the buffer. They are only valid until the
+// buffer is destroyed.
+func (sb *secureBuffer) Bytes() []byte {
+	return sb.buf
+}
+
+// Len returns the length of the contents.
+func (sb *secureBuffer) Len() int {
+	return len(sb.buf)
+}
+
+// truncate discards all but the first n bytes of the contents.
+func (sb *secureBuffer) truncate(n int) {
+	zero(sb.buf[n:])
+	sb.buf = sb.buf[:n]
+}
+
+// Read implements io.Reader. Once the contents have been read, the buffer is
+// destroyed.
+func (sb *secureBuffer) Read(p []byte) (int, error) {
+	if sb.off >= len(sb.buf) {
+		sb.Destroy()
+		return 0, io.EOF
+	}
+	n := copy(p, sb.buf[sb.off:])
+	sb.off += n
+	return n, nil
+}
+
+// destroyReader destroys r if it is a secure buffer, for contents which may
+// not have been read to EOF.
+func destroyReader(r io.Reader) {
+	if sb, ok := r.(*secureBuffer); ok {
+		sb.Destroy()
+	}
+}
+
+// Destroy zeroes the buffer and releases its memory. It may be called more
+// than once.
+func (sb *secureBuffer) Destroy() {
+	if sb.mem == nil {
+		return
+	}
+	zero(sb.mem)
+	freeSecure(sb.mem, sb.mapped)
+	sb.mem, sb.buf, sb.off = nil, nil, 0
+}
+
+// zero overwrites b with zeros.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
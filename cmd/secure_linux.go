@@ -0,0 +1,61 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"log"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var pageSize = os.Getpagesize()
+
+// lockFailed is used to warn once that memory could not be locked.
+var lockFailed sync.Once
+
+// allocSecure returns at least n bytes of anonymous memory, mapped apart from
+// the Go heap and locked. Locking fails beyond RLIMIT_MEMLOCK, in which case
+// a warning is logged, and the memory is still zeroed when freed. If memory
+// cannot be mapped at all, it is allocated from the heap.
+func allocSecure(n int) (mem []byte, mapped bool) {
+	size := (n + pageSize - 1) / pageSize * pageSize
+	if size == 0 {
+		size = pageSize
+	}
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		lockFailed.Do(func() {
+			log.Printf("warning: cannot map secure memory, secrets may be swapped to disk: %v", err)
+		})
+		return make([]byte, n), false
+	}
+	err = syscall.Mlock(mem)
+	if err != nil {
+		lockFailed.Do(func() {
+			log.Printf("warning: cannot lock memory, secrets may be swapped to disk: %v", err)
+		})
+	}
+	return mem, true
+}
+
+func freeSecure(mem []byte, mapped bool) {
+	if mapped {
+		syscall.Munlock(mem)
+		syscall.Munmap(mem)
+	}
+}
@@ -0,0 +1,428 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+	"gopkg.in/macaroon.v1"
+)
+
+// session holds what is needed to operate on objects in an oostore service:
+// the service URL, the client key pair and an HTTP client.
+type session struct {
+	url    string
+	key    *keyPair
+	client *http.Client
+
+	// dischargeTimeout limits how long to wait for each third-party
+	// discharge. Zero waits indefinitely.
+	dischargeTimeout time.Duration
+
+	// openBrowser is set if web pages for interactive discharge should be
+	// opened in a browser, rather than just displayed.
+	openBrowser bool
+
+	// nonInteractive is set if discharges requiring interaction should fail
+	// immediately.
+	nonInteractive bool
+
+	// dischargeCache holds third-party discharges across invocations, or is
+	// nil if discharges should not be cached.
+	dischargeCache *dischargeCache
+
+	// seal holds the options new objects are encrypted with.
+	seal sealOptions
+
+	// If ledger is not nil, new objects expire at expires: their auths
+	// carry a time-before caveat, and they are recorded in the ledger so
+	// that oo gc can delete them.
+	ledger  *ledger
+	expires time.Time
+}
+
+func newSession(ctx Context) (*session, error) {
+	urlStr := ctx.String("url")
+	if urlStr == "" {
+		ctx.ShowAppHelp()
+		return nil, errors.New("--url or OOSTORE_URL is required")
+	}
+	mgr := keyManager{ctx}
+	kp, err := mgr.keyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key: %v", err)
+	}
+	s := &session{
+		url:            urlStr,
+		key:            kp,
+		client:         http.DefaultClient,
+		openBrowser:    ctx.Bool("browser"),
+		nonInteractive: ctx.Bool("non-interactive"),
+	}
+	if !ctx.Bool("no-discharge-cache") {
+		s.dischargeCache, err = newDischargeCache(ctx)
+		if err != nil {
+			kp.wipe()
+			return nil, err
+		}
+	}
+	if timeout := ctx.String("discharge-timeout"); timeout != "" {
+		s.dischargeTimeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			kp.wipe()
+			return nil, fmt.Errorf("invalid --discharge-timeout: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// close wipes the session's key pair. Sessions returned by at share it, so
+// only the original session should be closed, once all are done.
+func (s *session) close() {
+	s.key.wipe()
+}
+
+// at returns a session for the oostore service at the given URL, sharing
+// this session's key pair and HTTP client.
+func (s *session) at(urlStr string) *session {
+	s2 := *s
+	s2.url = urlStr
+	return &s2
+}
+
+// create encrypts contents and stores the ciphertext as a new object. The
+// returned auth carries a client:encrypt caveat addressed to the given
+// recipient. The input metadata is recorded in the envelope.
+func (s *session) create(contents io.ReadCloser, meta metadata, to *bakery.PublicKey) (macaroon.Slice, error) {
+	var auth macaroon.Slice
+	err := s.createEscrowed(contents, meta, to, nil, func(ms, _ macaroon.Slice) error {
+		auth = ms
+		return nil
+	})
+	return auth, err
+}
+
+// createEscrowed is like create, but if escrow is not nil it also makes a
+// separate auth for the object whose client:encrypt caveat is addressed to
+// escrow. The holder of the escrow key can use it to recover the object.
+// Both auths are passed to write; if it fails, the object is deleted, so
+// that nothing is left stored which no auth was written for.
+func (s *session) createEscrowed(contents io.ReadCloser, meta metadata, to, escrow *bakery.PublicKey, write func(auth, escrowAuth macaroon.Slice) error) error {
+	env, body, err := encrypt(contents, s.seal)
+	if err != nil {
+		return err
+	}
+	defer env.wipe()
+	env.metadata = meta
+	// The content type is only recorded in the envelope. The service stores
+	// ciphertext, and need not know what it is.
+	ms, err := s.newObject(body, "")
+	if err != nil {
+		return err
+	}
+	bare := macaroon.Slice{ms[0].Clone()}
+	var escrowAuth macaroon.Slice
+	if escrow != nil {
+		m := ms[0].Clone()
+		err = s.addEncryptCaveat(m, env, escrow)
+		if err != nil {
+			err = fmt.Errorf("failed to add escrow caveat: %v", err)
+		}
+		escrowAuth = macaroon.Slice{m}
+	}
+	if err == nil {
+		err = s.addEncryptCaveat(ms[0], env, to)
+		if err != nil {
+			err = fmt.Errorf("failed to add third-party caveat: %v", err)
+		}
+	}
+	if err == nil {
+		err = write(ms, escrowAuth)
+	}
+	if err != nil {
+		if rbErr := s.deleteObject(bare); rbErr != nil {
+			log.Printf("failed to delete new object: %v", rbErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// newObject stores the contents of r as a new object, returning the auth
+// issued by the service, which expires if the session has a ledger.
+func (s *session) newObject(r io.Reader, contentType string) (macaroon.Slice, error) {
+	req, err := http.NewRequest("POST", s.url, r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request %q: %v", s.url, err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %q: %v", s.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errHTTPResponse(resp)
+	}
+	ms, err := unmarshalAuth(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth response: %v", err)
+	}
+	if len(ms) == 0 {
+		return nil, errors.New("invalid auth response: missing macaroon")
+	}
+	if s.ledger != nil {
+		err = s.ledger.record(s.url, ms, s.expires)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record object in ledger: %v", err)
+		}
+		err = addCaveats(ms, []string{checkers.TimeBeforeCaveat(s.expires).Condition})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+// addEncryptCaveat adds a third-party caveat to m, addressed to the given
+// recipient, which carries the envelope needed to decrypt the object.
+func (s *session) addEncryptCaveat(m *macaroon.Macaroon, env *envelope, to *bakery.PublicKey) error {
+	return addEncryptCaveat(m, env, s.key, to)
+}
+
+func addEncryptCaveat(m *macaroon.Macaroon, env *envelope, key *keyPair, to *bakery.PublicKey) error {
+	condition, err := env.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	agent, err := bakery.NewService(bakery.NewServiceParams{
+		Key:     key.KeyPair,
+		Locator: clientLocator{to},
+	})
+	if err != nil {
+		return err
+	}
+	return agent.AddCaveat(m, checkers.Caveat{Location: "client:encrypt", Condition: string(condition)})
+}
+
+// discharge acquires discharges for the third-party caveats in ms which are
+// not already discharged. The envelope is returned if a client:encrypt caveat
+// was discharged with the client key; the caller must wipe it.
+func (s *session) discharge(ms macaroon.Slice) (macaroon.Slice, *envelope, error) {
+	cl := httpbakery.NewClient()
+	cl.Client = s.client
+	da := &dischargeAcquirer{
+		client:         cl,
+		timeout:        s.dischargeTimeout,
+		cache:          s.dischargeCache,
+		nonInteractive: s.nonInteractive,
+	}
+	cl.DischargeAcquirer = da
+	cl.Key = s.key.KeyPair
+	cl.VisitWebPage = s.visitWebPage
+	ms, err := dischargeAll(ms, da)
+	if err != nil {
+		da.env.wipe()
+		return nil, nil, err
+	}
+	return ms, da.env, nil
+}
+
+// dischargeAll returns the primary macaroon of ms with discharges for all of
+// its third-party caveats, and those of the discharges. Discharges already
+// in ms are kept as they are; missing ones are acquired with da and bound to
+// the primary. The envelope of a client:encrypt caveat which is already
+// discharged is still recovered into da, if it is addressed to da's key.
+func dischargeAll(ms macaroon.Slice, da *dischargeAcquirer) (macaroon.Slice, error) {
+	if len(ms) == 0 {
+		return nil, errors.New("missing auth")
+	}
+	primary := ms[0]
+	have := make(map[string]*macaroon.Macaroon)
+	for _, m := range ms[1:] {
+		have[m.Id()] = m
+	}
+
+	result := macaroon.Slice{primary}
+	need := thirdPartyCaveats(primary)
+	for len(need) > 0 {
+		cav := need[0]
+		need = need[1:]
+		dm, ok := have[cav.Id]
+		if ok {
+			delete(have, cav.Id)
+			if cav.Location == "client:encrypt" && da.env == nil {
+				// The discharge may have been acquired by someone
+				// else; without our key the envelope stays unknown.
+				da.openEnvelope(cav)
+			}
+		} else {
+			var err error
+			dm, err = da.AcquireDischarge(primary.Location(), cav)
+			if err != nil {
+				return nil, fmt.Errorf("cannot get discharge from %q: %v", cav.Location, err)
+			}
+			dm.Bind(primary.Signature())
+		}
+		result = append(result, dm)
+		need = append(need, thirdPartyCaveats(dm)...)
+	}
+	return result, nil
+}
+
+func thirdPartyCaveats(m *macaroon.Macaroon) []macaroon.Caveat {
+	var cavs []macaroon.Caveat
+	for _, cav := range m.Caveats() {
+		if cav.Location != "" {
+			cavs = append(cavs, cav)
+		}
+	}
+	return cavs
+}
+
+// hasEncryptCaveat returns whether m has a client:encrypt caveat.
+func hasEncryptCaveat(m *macaroon.Macaroon) bool {
+	for _, cav := range thirdPartyCaveats(m) {
+		if cav.Location == "client:encrypt" {
+			return true
+		}
+	}
+	return false
+}
+
+// visitWebPage is called when a third-party discharger requires the user to
+// interact with a web page before it will issue a discharge. Once it returns,
+// the httpbakery client waits for the discharge to be issued.
+func (s *session) visitWebPage(u *url.URL) error {
+	if s.nonInteractive {
+		return fmt.Errorf("interaction required at %s", u)
+	}
+	log.Printf("to authorize a discharge, visit %s", u)
+	if s.openBrowser {
+		err := httpbakery.OpenWebBrowser(u)
+		if err != nil {
+			log.Printf("failed to open web browser: %v", err)
+		}
+	}
+	return nil
+}
+
+// fetch discharges ms and returns the decrypted contents of the object it
+// authorizes, along with its envelope if it has one, which the caller must
+// wipe.
+func (s *session) fetch(ms macaroon.Slice) (io.Reader, *envelope, error) {
+	ms, env, err := s.discharge(ms)
+	if err != nil {
+		return nil, nil, err
+	}
+	if env == nil && hasEncryptCaveat(ms[0]) {
+		// The contents are encrypted, but not to us. Don't pass
+		// off ciphertext as the object.
+		return nil, nil, errors.New("cannot decrypt contents: client:encrypt caveat is not addressed to this key")
+	}
+	body, err := s.fetchObject(ms)
+	if err != nil {
+		env.wipe()
+		return nil, nil, err
+	}
+	defer body.Close()
+	if env == nil {
+		var contents bytes.Buffer
+		_, err = io.Copy(&contents, body)
+		return &contents, nil, err
+	}
+	contents, err := env.decrypt(body)
+	if err != nil {
+		env.wipe()
+		return nil, nil, fmt.Errorf("error decrypting contents: %v", err)
+	}
+	return contents, env, nil
+}
+
+// fetchObject requests the contents of the object authorized by ms, which
+// must already be discharged. The caller must close the returned body.
+func (s *session) fetchObject(ms macaroon.Slice) (io.ReadCloser, error) {
+	resp, err := s.request("POST", ms)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, errHTTPResponse(resp)
+	}
+	return resp.Body, nil
+}
+
+// delete discharges ms and deletes the object it authorizes.
+func (s *session) delete(ms macaroon.Slice) error {
+	ms, env, err := s.discharge(ms)
+	if err != nil {
+		return err
+	}
+	env.wipe()
+	return s.deleteObject(ms)
+}
+
+// deleteObject deletes the object authorized by ms, which must already be
+// discharged.
+func (s *session) deleteObject(ms macaroon.Slice) error {
+	resp, err := s.request("DELETE", ms)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return errHTTPResponse(resp)
+	}
+	return nil
+}
+
+func (s *session) request(method string, ms macaroon.Slice) (*http.Response, error) {
+	id, err := objectID(ms)
+	if err != nil {
+		return nil, err
+	}
+	var authBuf bytes.Buffer
+	err = json.NewEncoder(&authBuf).Encode(ms)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, s.url+"/"+id, &authBuf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request %q: %v", s.url, err)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %q: %v", s.url, err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon.v1"
+)
+
+// shardManifest is the auth for an object whose ciphertext was too large to
+// store as a single object, and was split into shards stored as separate
+// objects.
+type shardManifest struct {
+	Shards []shard `json:"shards"`
+}
+
+// shard is a piece of a sharded object's ciphertext.
+type shard struct {
+	// Index is the position of the shard in the ciphertext.
+	Index int `json:"index"`
+
+	// Auth authorizes access to the object storing the shard.
+	Auth macaroon.Slice `json:"auth"`
+
+	// Size is the length of the shard.
+	Size int `json:"size"`
+
+	// SHA384 is the digest of the shard.
+	SHA384 []byte `json:"sha384"`
+}
+
+// isShardManifest returns whether the auth in buf is a shard manifest rather
+// than a macaroon slice.
+func isShardManifest(buf []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(buf), []byte("{"))
+}
+
+func unmarshalShardManifest(buf []byte) (*shardManifest, error) {
+	var m shardManifest
+	err := json.Unmarshal(buf, &m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode shard manifest: %v", err)
+	}
+	if len(m.Shards) == 0 {
+		return nil, fmt.Errorf("invalid shard manifest: no shards")
+	}
+	for i := range m.Shards {
+		if m.Shards[i].Index != i {
+			return nil, fmt.Errorf("invalid shard manifest: shard %d out of order", i)
+		}
+	}
+	return &m, nil
+}
+
+// fetchAuth fetches the object authorized by the auth in buf, which may be a
+// macaroon slice or a shard manifest.
+func (s *session) fetchAuth(buf []byte) (io.Reader, *envelope, error) {
+	if isShardManifest(buf) {
+		m, err := unmarshalShardManifest(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.fetchSharded(m)
+	}
+	ms, err := unmarshalAuth(bytes.NewReader(buf))
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.fetch(ms)
+}
+
+// deleteAuth deletes the object authorized by the auth in buf, which may be a
+// macaroon slice or a shard manifest.
+func (s *session) deleteAuth(buf []byte) error {
+	if isShardManifest(buf) {
+		m, err := unmarshalShardManifest(buf)
+		if err != nil {
+			return err
+		}
+		return s.deleteSharded(m)
+	}
+	ms, err := unmarshalAuth(bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	return s.delete(ms)
+}
+
+// shardWorkers is the number of shards stored or fetched at once.
+const shardWorkers = 4
+
+// eachShard calls f with each index from 0 to n-1, from at most shardWorkers
+// goroutines at once, and returns when every call has returned.
+func eachShard(n int, f func(i int)) {
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < shardWorkers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// createSharded encrypts contents and stores the ciphertext in shards of at
+// most shardSize bytes, several at once. Each shard's auth carries the same
+// client:encrypt caveat. If any shard cannot be stored, those already stored
+// are deleted.
+func (s *session) createSharded(contents io.ReadCloser, meta metadata, to *bakery.PublicKey, shardSize int) (*shardManifest, error) {
+	env, body, err := encrypt(contents, s.seal)
+	if err != nil {
+		return nil, err
+	}
+	defer env.wipe()
+	env.metadata = meta
+	ciphertext, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks [][]byte
+	for len(ciphertext) > 0 {
+		n := shardSize
+		if n > len(ciphertext) {
+			n = len(ciphertext)
+		}
+		chunks = append(chunks, ciphertext[:n])
+		ciphertext = ciphertext[n:]
+	}
+	auths := make([]macaroon.Slice, len(chunks))
+	stored := make([]macaroon.Slice, len(chunks))
+	errs := make([]error, len(chunks))
+	eachShard(len(chunks), func(i int) {
+		auths[i], errs[i] = s.newObject(bytes.NewReader(chunks[i]), "")
+		if errs[i] == nil {
+			stored[i] = macaroon.Slice{auths[i][0].Clone()}
+		}
+	})
+
+	var m shardManifest
+	for i, chunk := range chunks {
+		err = errs[i]
+		if err == nil {
+			err = s.addEncryptCaveat(auths[i][0], env, to)
+		}
+		if err != nil {
+			for _, bare := range stored {
+				if bare == nil {
+					continue
+				}
+				if rbErr := s.deleteObject(bare); rbErr != nil {
+					log.Printf("failed to delete shard: %v", rbErr)
+				}
+			}
+			return nil, fmt.Errorf("failed to store shard %d: %v", i, err)
+		}
+		digest := sha512.Sum384(chunk)
+		m.Shards = append(m.Shards, shard{
+			Index:  i,
+			Auth:   auths[i],
+			Size:   len(chunk),
+			SHA384: digest[:],
+		})
+	}
+	return &m, nil
+}
+
+// fetchSharded fetches the shards of an object, several at once, verifies
+// them and returns the decrypted contents of the reassembled object.
+func (s *session) fetchSharded(m *shardManifest) (io.Reader, *envelope, error) {
+	chunks := make([][]byte, len(m.Shards))
+	envs := make([]*envelope, len(m.Shards))
+	errs := make([]error, len(m.Shards))
+	eachShard(len(m.Shards), func(i int) {
+		chunks[i], envs[i], errs[i] = s.fetchShard(&m.Shards[i])
+	})
+	// Every envelope is wiped, except the one returned.
+	keep := -1
+	defer func() {
+		for i, env := range envs {
+			if i != keep {
+				env.wipe()
+			}
+		}
+	}()
+
+	var ciphertext bytes.Buffer
+	for i := range m.Shards {
+		if errs[i] != nil {
+			return nil, nil, fmt.Errorf("failed to fetch shard %d: %v", i, errs[i])
+		}
+		if envs[i] == nil {
+			return nil, nil, fmt.Errorf("shard %d has no decryption envelope", i)
+		}
+		if !envs[i].equal(envs[0]) {
+			return nil, nil, fmt.Errorf("shard %d envelope mismatch", i)
+		}
+		ciphertext.Write(chunks[i])
+	}
+	contents, err := envs[0].decrypt(&ciphertext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decrypting contents: %v", err)
+	}
+	keep = 0
+	return contents, envs[0], nil
+}
+
+func (s *session) fetchShard(sh *shard) ([]byte, *envelope, error) {
+	ms, env, err := s.discharge(sh.Auth)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunk, err := s.fetchChunk(ms, sh)
+	if err != nil {
+		env.wipe()
+		return nil, nil, err
+	}
+	return chunk, env, nil
+}
+
+// fetchChunk fetches the ciphertext of a shard and checks it against the
+// manifest.
+func (s *session) fetchChunk(ms macaroon.Slice, sh *shard) ([]byte, error) {
+	body, err := s.fetchObject(ms)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	chunk, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunk) != sh.Size {
+		return nil, fmt.Errorf("size mismatch: expected %d, got %d", sh.Size, len(chunk))
+	}
+	digest := sha512.Sum384(chunk)
+	if !bytes.Equal(digest[:], sh.SHA384) {
+		return nil, fmt.Errorf("digest mismatch")
+	}
+	return chunk, nil
+}
+
+// deleteSharded deletes every shard of an object. Deletion continues past
+// shards which fail to delete; an error is returned if any did.
+func (s *session) deleteSharded(m *shardManifest) error {
+	var failed int
+	for i := range m.Shards {
+		err := s.delete(m.Shards[i].Auth)
+		if err != nil {
+			log.Printf("failed to delete shard %d: %v", i, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to delete %d of %d shards", failed, len(m.Shards))
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon-bakery.v1/httpbakery"
+	"gopkg.in/macaroon.v1"
+)
+
+type shareCommand struct{}
+
+// NewShareCommand returns a Command that delegates an opaque object auth to
+// another recipient.
+func NewShareCommand() *shareCommand {
+	return &shareCommand{}
+}
+
+// CLICommand implements Command.
+func (c *shareCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "share",
+		Usage:  "attenuate auth and re-address it to another recipient",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name: "input, i",
+			},
+			cli.StringFlag{
+				Name: "output, o",
+			},
+			cli.StringFlag{
+				Name:   "auth-format",
+				EnvVar: "OO_AUTH_FORMAT",
+				Usage:  "auth output format: json, b64, armor or binary",
+				Value:  "json",
+			},
+			cli.StringFlag{
+				Name:   "macaroon-version",
+				EnvVar: "OO_MACAROON_VERSION",
+				Usage:  "macaroon serialization version of output auths: 1 or 2",
+				Value:  "1",
+			},
+			cli.StringFlag{
+				Name:  "to, t",
+				Usage: "recipient contact name or base58 public key",
+			},
+			cli.StringFlag{
+				Name:  "expires",
+				Usage: "how long the shared auth is valid, such as 12h or 7d",
+			},
+			cli.StringFlag{
+				Name:  "op",
+				Usage: "comma-separated operations allowed: fetch, delete",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *shareCommand) Do(ctx Context) error {
+	if ctx.String("to") == "" {
+		ctx.ShowAppHelp()
+		return errors.New("--to is required")
+	}
+	var caveats []string
+	if expires := ctx.String("expires"); expires != "" {
+		d, err := parseDuration(expires)
+		if err != nil {
+			return fmt.Errorf("invalid --expires: %v", err)
+		}
+		caveats = append(caveats, checkers.TimeBeforeCaveat(time.Now().Add(d)).Condition)
+	}
+	if op := ctx.String("op"); op != "" {
+		caveats = append(caveats, "operation "+op)
+	}
+
+	kp, err := keyManager{ctx}.keyPair()
+	if err != nil {
+		return fmt.Errorf("failed to load key: %v", err)
+	}
+	defer kp.wipe()
+	to, err := recipientKey(ctx, kp)
+	if err != nil {
+		return err
+	}
+	ms, err := readInputAuth(ctx)
+	if err != nil {
+		return err
+	}
+	ms, err = share(ms, kp, to, caveats)
+	if err != nil {
+		return fmt.Errorf("cannot share: %v", err)
+	}
+	return writeAuth(ctx, ms)
+}
+
+// share returns an auth for the object authorized by ms, attenuated with the
+// given first-party caveats and readable by the recipient. Our client:encrypt
+// caveats are discharged with kp, and the envelope they carry is added in a
+// new client:encrypt caveat addressed to the recipient.
+//
+// Discharges already bound to ms cannot be bound again once caveats are
+// added, so any other than client:encrypt are dropped, for the recipient to
+// acquire again.
+func share(ms macaroon.Slice, kp *keyPair, to *bakery.PublicKey, caveats []string) (macaroon.Slice, error) {
+	if len(ms) > 1 {
+		log.Printf("dropping %d bound discharges; the recipient must acquire them again", len(ms)-1)
+	}
+	m := ms[0].Clone()
+	cl := httpbakery.NewClient()
+	cl.Key = kp.KeyPair
+	da := &dischargeAcquirer{client: cl}
+	// da.env is only set once the client:encrypt caveat is discharged.
+	defer func() { da.env.wipe() }()
+	var discharges macaroon.Slice
+	for _, cav := range thirdPartyCaveats(m) {
+		if cav.Location != "client:encrypt" {
+			continue
+		}
+		dm, err := da.AcquireDischarge(m.Location(), cav)
+		if err != nil {
+			return nil, fmt.Errorf("client:encrypt caveat is not addressed to this key: %v", err)
+		}
+		discharges = append(discharges, dm)
+	}
+	if da.env == nil {
+		return nil, errors.New("auth has no decryption envelope")
+	}
+
+	err := addCaveats(macaroon.Slice{m}, caveats)
+	if err != nil {
+		return nil, err
+	}
+	err = addEncryptCaveat(m, da.env, kp, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add third-party caveat: %v", err)
+	}
+	result := macaroon.Slice{m}
+	for _, dm := range discharges {
+		dm.Bind(m.Signature())
+		result = append(result, dm)
+	}
+	return result, nil
+}
+
+// parseDuration parses a duration as time.ParseDuration does, also accepting
+// a whole number of days, such as "7d".
+func parseDuration(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
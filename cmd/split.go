@@ -0,0 +1,398 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon-bakery.v1/bakery"
+	"gopkg.in/macaroon.v1"
+)
+
+// GF(2^8) arithmetic with the AES polynomial, for Shamir secret sharing.
+var gfExp, gfLog [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = byte(i)
+		// multiply by the generator 3
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	gfExp[255] = gfExp[0]
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+int(gfLog[b]))%255]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a])+255-int(gfLog[b]))%255]
+}
+
+// splitSecret splits secret into n shares, any k of which reconstruct it.
+// Share i is evaluated at x = i+1.
+func splitSecret(secret []byte, k, n int) ([][]byte, error) {
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	coeffs := make([]byte, k)
+	for j, b := range secret {
+		coeffs[0] = b
+		_, err := io.ReadFull(rand.Reader, coeffs[1:])
+		if err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := byte(i + 1)
+			// Horner's method, from the highest coefficient down.
+			var y byte
+			for c := k - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coeffs[c]
+			}
+			shares[i][j] = y
+		}
+	}
+	for i := range coeffs {
+		coeffs[i] = 0
+	}
+	return shares, nil
+}
+
+// combineSecret reconstructs a secret from shares evaluated at xs, by
+// Lagrange interpolation at zero, into secret, which must be zeroed and as
+// long as each share.
+func combineSecret(xs []byte, shares [][]byte, secret []byte) {
+	for i, xi := range xs {
+		// basis polynomial for share i, at zero
+		l := byte(1)
+		for j, xj := range xs {
+			if i != j {
+				l = gfMul(l, gfDiv(xj, xi^xj))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(l, shares[i][b])
+		}
+	}
+}
+
+// secretShareMagic begins the contents of each object holding a secret share.
+const secretShareMagic = "oo-split2"
+
+// secretShareKeySize is the size of the random HMAC key which is split along
+// with the secret. Fewer than k shares reveal nothing about the key, so the
+// MAC in each share reveals nothing about the secret.
+const secretShareKeySize = 32
+
+// secretShare is a Shamir share of a secret, with what is needed to combine
+// it with others and check the result. y is a share of the HMAC key followed
+// by the secret.
+type secretShare struct {
+	threshold byte
+	x         byte
+	mac       [sha512.Size384]byte
+	y         []byte
+}
+
+func (s *secretShare) marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(secretShareMagic)
+	buf.WriteByte(s.threshold)
+	buf.WriteByte(s.x)
+	buf.Write(s.mac[:])
+	buf.Write(s.y)
+	return buf.Bytes()
+}
+
+func unmarshalSecretShare(buf []byte) (*secretShare, error) {
+	headerLen := len(secretShareMagic) + 2 + sha512.Size384
+	if len(buf) < headerLen || string(buf[:len(secretShareMagic)]) != secretShareMagic {
+		return nil, errors.New("not a secret share")
+	}
+	buf = buf[len(secretShareMagic):]
+	s := &secretShare{threshold: buf[0], x: buf[1], y: buf[2+sha512.Size384:]}
+	copy(s.mac[:], buf[2:])
+	if s.threshold == 0 || s.x == 0 || len(s.y) < secretShareKeySize {
+		return nil, errors.New("invalid secret share")
+	}
+	return s, nil
+}
+
+// secretMAC returns the HMAC-SHA384 of secret under key.
+func secretMAC(key, secret []byte) [sha512.Size384]byte {
+	var sum [sha512.Size384]byte
+	h := hmac.New(sha512.New384, key)
+	h.Write(secret)
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// parseSplit parses a --split threshold of the form "k-of-n".
+func parseSplit(split string) (k, n int, err error) {
+	parts := strings.Split(split, "-of-")
+	if len(parts) == 2 {
+		k, err = strconv.Atoi(parts[0])
+		if err == nil {
+			n, err = strconv.Atoi(parts[1])
+		}
+	}
+	if len(parts) != 2 || err != nil || k < 1 || n < k || n > 255 {
+		return 0, 0, fmt.Errorf("invalid --split %q, expected k-of-n with 1 <= k <= n <= 255", split)
+	}
+	return k, n, nil
+}
+
+// createSplit splits contents into secret shares, any k of which reconstruct
+// it, and stores each share as an object addressed to one recipient. If any
+// share cannot be stored, those already stored are deleted.
+func (s *session) createSplit(contents io.Reader, meta metadata, recipients []*bakery.PublicKey, k int) ([]macaroon.Slice, error) {
+	// The secret, and the key split along with it, are only held in
+	// secure buffers.
+	secret, err := readSecure(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input: %v", err)
+	}
+	defer secret.Destroy()
+	keyed := newSecureBuffer(secretShareKeySize + secret.Len())
+	defer keyed.Destroy()
+	key := keyed.Bytes()[:secretShareKeySize]
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	mac := secretMAC(key, secret.Bytes())
+	copy(keyed.Bytes()[secretShareKeySize:], secret.Bytes())
+	ys, err := splitSecret(keyed.Bytes(), k, len(recipients))
+	if err != nil {
+		return nil, err
+	}
+
+	var auths, stored []macaroon.Slice
+	for i, to := range recipients {
+		share := &secretShare{threshold: byte(k), x: byte(i + 1), mac: mac, y: ys[i]}
+		env, body, err := encrypt(ioutil.NopCloser(bytes.NewReader(share.marshal())), s.seal)
+		if err != nil {
+			return nil, err
+		}
+		env.metadata = meta
+		ms, err := s.newObject(body, "")
+		if err == nil {
+			stored = append(stored, macaroon.Slice{ms[0].Clone()})
+			err = s.addEncryptCaveat(ms[0], env, to)
+		}
+		env.wipe()
+		if err != nil {
+			for _, bare := range stored {
+				if rbErr := s.deleteObject(bare); rbErr != nil {
+					log.Printf("failed to delete share: %v", rbErr)
+				}
+			}
+			return nil, fmt.Errorf("failed to store share %d: %v", i+1, err)
+		}
+		auths = append(auths, ms)
+	}
+	return auths, nil
+}
+
+// combine fetches secret shares and reconstructs the secret from them. The
+// result is checked against the MAC recorded in every share, under the key
+// reconstructed along with it. The shares and the secret are only held in
+// secure buffers; the caller must destroy the one returned.
+func (s *session) combine(auths [][]byte) (*secureBuffer, error) {
+	var xs []byte
+	var ys [][]byte
+	var first *secretShare
+	// Each share's y refers to its buffer, so all are kept until combined.
+	var shareBufs []*secureBuffer
+	defer func() {
+		for _, sb := range shareBufs {
+			sb.Destroy()
+		}
+	}()
+	for i, buf := range auths {
+		contents, env, err := s.fetchAuth(buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch share %d: %v", i+1, err)
+		}
+		env.wipe()
+		shareBuf, err := readSecure(contents)
+		destroyReader(contents)
+		if err != nil {
+			return nil, err
+		}
+		shareBufs = append(shareBufs, shareBuf)
+		share, err := unmarshalSecretShare(shareBuf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("share %d: %v", i+1, err)
+		}
+		if first == nil {
+			first = share
+		} else if share.threshold != first.threshold || share.mac != first.mac || len(share.y) != len(first.y) {
+			return nil, fmt.Errorf("share %d is from a different secret", i+1)
+		}
+		if bytes.IndexByte(xs, share.x) >= 0 {
+			return nil, fmt.Errorf("share %d is a duplicate", i+1)
+		}
+		xs = append(xs, share.x)
+		ys = append(ys, share.y)
+	}
+	if len(xs) < int(first.threshold) {
+		return nil, fmt.Errorf("need %d shares, got %d", first.threshold, len(xs))
+	}
+	keyed := newSecureBuffer(len(first.y))
+	combineSecret(xs, ys, keyed.Bytes())
+	key, secret := keyed.Bytes()[:secretShareKeySize], keyed.Bytes()[secretShareKeySize:]
+	mac := secretMAC(key, secret)
+	if !hmac.Equal(mac[:], first.mac[:]) {
+		keyed.Destroy()
+		return nil, errors.New("combined secret does not match its MAC")
+	}
+	// Drop the key, leaving the secret at the start of the buffer.
+	copy(keyed.Bytes(), secret)
+	keyed.truncate(len(secret))
+	return keyed, nil
+}
+
+// writeSplitAuths writes the auth for each share to dir, as share-<n>.auth.
+func writeSplitAuths(dir string, auths []macaroon.Slice, format authEncoding) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	for i, ms := range auths {
+		path := filepath.Join(dir, fmt.Sprintf("share-%d.auth", i+1))
+		err = writeFileAtomic(path, 0600, false, func(w io.Writer) error {
+			return encodeAuth(w, ms, format)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type combineCommand struct{}
+
+// NewCombineCommand returns a Command that reconstructs an object split into
+// secret shares.
+func NewCombineCommand() *combineCommand {
+	return &combineCommand{}
+}
+
+// CLICommand implements Command.
+func (c *combineCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "combine",
+		Usage:  "fetch secret shares and combine them: combine <auth>...",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "url",
+				EnvVar: "OOSTORE_URL",
+				Value:  defaultURL,
+			},
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+			cli.StringFlag{
+				Name:  "discharge-timeout",
+				Usage: "how long to wait for each third-party discharge",
+				Value: "10m",
+			},
+			cli.BoolFlag{
+				Name:  "browser",
+				Usage: "open web pages for interactive discharge in a browser",
+			},
+			cli.BoolFlag{
+				Name:  "non-interactive",
+				Usage: "fail if a discharge requires interaction",
+			},
+			cli.BoolFlag{
+				Name:  "no-discharge-cache",
+				Usage: "do not use or store cached discharges",
+			},
+			cli.StringFlag{
+				Name: "output, o",
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *combineCommand) Do(ctx Context) error {
+	if len(ctx.Args()) == 0 {
+		ctx.ShowAppHelp()
+		return errors.New("usage: combine <auth>...")
+	}
+	var auths [][]byte
+	for _, authFile := range ctx.Args() {
+		buf, err := ioutil.ReadFile(authFile)
+		if err != nil {
+			return fmt.Errorf("cannot read %q: %v", authFile, err)
+		}
+		auths = append(auths, buf)
+	}
+	s, err := newSession(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	secret, err := s.combine(auths)
+	if err != nil {
+		return err
+	}
+	defer secret.Destroy()
+
+	outputFile := ctx.String("output")
+	if outputFile == "" {
+		_, err = ctx.Stdout().Write(secret.Bytes())
+		return err
+	}
+	return writeFileAtomic(outputFile, 0600, false, func(w io.Writer) error {
+		_, err := w.Write(secret.Bytes())
+		return err
+	})
+}
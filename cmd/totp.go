@@ -0,0 +1,322 @@
+/*
+ * Copyright 2015 Casey Marshall
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"gopkg.in/macaroon-bakery.v1/bakery/checkers"
+	"gopkg.in/macaroon.v1"
+)
+
+const (
+	// totpPath is the path under which a TOTP discharge service is served.
+	// Clients recognize third-party caveats addressed to a location ending
+	// in this path as requiring a TOTP code.
+	totpPath = "/totp"
+
+	// totpStep is the time step between codes.
+	totpStep = 30 * time.Second
+
+	// defaultTOTPTTL is how long a TOTP discharge is valid, unless
+	// --totp-ttl is given.
+	defaultTOTPTTL = time.Minute
+)
+
+// hotpCode returns the 6-digit RFC 4226 code for secret at the given counter.
+func hotpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// totpCounter returns the RFC 6238 time step counter at t.
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix() / int64(totpStep/time.Second))
+}
+
+func isTOTPLocation(location string) bool {
+	u, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+	return strings.TrimSuffix(u.Path, "/") == totpPath
+}
+
+func totpSecretPath(ctx Context, issuer string) (string, error) {
+	if issuer == "" || strings.ContainsAny(issuer, `/\`) || issuer == "." || issuer == ".." {
+		return "", fmt.Errorf("invalid TOTP issuer %q", issuer)
+	}
+	home, err := keyManager{ctx}.homeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "totp", issuer), nil
+}
+
+// totpChecker discharges conditions of the form "totp <issuer>" when the
+// discharge request carries a valid code for the issuer's secret. Each code
+// is accepted only once, and its discharge expires after ttl, so that a code
+// grants access for a short time only, even if the discharge is bound into
+// an auth.
+type totpChecker struct {
+	ctx Context
+	ttl time.Duration
+
+	mu       sync.Mutex
+	lastUsed map[string]uint64
+}
+
+func newTOTPChecker(ctx Context) (dischargeChecker, error) {
+	ttl := defaultTOTPTTL
+	if s := ctx.String("totp-ttl"); s != "" {
+		var err error
+		ttl, err = time.ParseDuration(s)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid --totp-ttl %q", s)
+		}
+	}
+	return &totpChecker{ctx: ctx, ttl: ttl, lastUsed: make(map[string]uint64)}, nil
+}
+
+func (c *totpChecker) checkCondition(req *http.Request, condition string) ([]checkers.Caveat, error) {
+	cond, issuer, err := checkers.ParseCaveat(condition)
+	if err != nil {
+		return nil, err
+	}
+	if cond != "totp" {
+		return nil, errors.New("unsupported condition")
+	}
+	secretPath, err := totpSecretPath(c.ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := ioutil.ReadFile(secretPath)
+	if err != nil {
+		return nil, fmt.Errorf("unknown TOTP issuer %q", issuer)
+	}
+	secret, err := base32.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret for TOTP issuer %q", issuer)
+	}
+
+	code := req.FormValue("totp")
+	if code == "" {
+		return nil, errors.New("TOTP code required")
+	}
+	// RFC 6238 codes are HOTP codes for the current time step. Allow for
+	// one step of clock skew either way.
+	now := totpCounter(time.Now())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, counter := range []uint64{now - 1, now, now + 1} {
+		if !hmac.Equal([]byte(hotpCode(secret, counter)), []byte(code)) {
+			continue
+		}
+		if counter <= c.lastUsed[issuer] {
+			return nil, errors.New("TOTP code already used")
+		}
+		c.lastUsed[issuer] = counter
+		return []checkers.Caveat{checkers.TimeBeforeCaveat(time.Now().Add(c.ttl))}, nil
+	}
+	return nil, errors.New("invalid TOTP code")
+}
+
+// totpLocationConfigured returns whether location is one of the TOTP
+// discharge services listed in $OO_TOTP_LOCATIONS, separated by commas.
+func totpLocationConfigured(location string) bool {
+	location = strings.TrimSuffix(location, "/")
+	for _, l := range strings.Split(os.Getenv("OO_TOTP_LOCATIONS"), ",") {
+		if l = strings.TrimSuffix(strings.TrimSpace(l), "/"); l != "" && l == location {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmTOTPLocation returns an error unless the user is willing to send a
+// TOTP code to location. Any caveat location ending in /totp is treated as a
+// TOTP service, so it must be configured, or confirmed on the terminal.
+func (da *dischargeAcquirer) confirmTOTPLocation(location string) error {
+	if totpLocationConfigured(location) {
+		return nil
+	}
+	notConfigured := fmt.Errorf("TOTP location %q is not in $OO_TOTP_LOCATIONS", location)
+	if da.nonInteractive {
+		return notConfigured
+	}
+	answer, err := promptTTY(fmt.Sprintf("Send a TOTP code to %s? [y/N] ", location))
+	if err != nil {
+		return notConfigured
+	}
+	if answer = strings.ToLower(answer); answer != "y" && answer != "yes" {
+		return fmt.Errorf("TOTP location %q not confirmed", location)
+	}
+	return nil
+}
+
+// acquireTOTP requests a discharge from a TOTP discharge service, sending a
+// code taken from $OO_TOTP or prompted for on the terminal. The location
+// must be configured or confirmed first.
+func (da *dischargeAcquirer) acquireTOTP(firstPartyLocation string, cav macaroon.Caveat) (*macaroon.Macaroon, error) {
+	err := da.confirmTOTPLocation(cav.Location)
+	if err != nil {
+		return nil, err
+	}
+	code := os.Getenv("OO_TOTP")
+	if code == "" {
+		code, err = promptTTY(fmt.Sprintf("TOTP code for %s: ", cav.Location))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read TOTP code: %v", err)
+		}
+	}
+	client := da.client.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	dischargeURL := strings.TrimSuffix(cav.Location, "/") + "/discharge"
+	resp, err := client.PostForm(dischargeURL, url.Values{
+		"id":       {cav.Id},
+		"location": {firstPartyLocation},
+		"totp":     {strings.TrimSpace(code)},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %q: %v", dischargeURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errHTTPResponse(resp)
+	}
+	var dischargeResp struct {
+		Macaroon *macaroon.Macaroon
+	}
+	err = json.NewDecoder(resp.Body).Decode(&dischargeResp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid discharge response: %v", err)
+	}
+	if dischargeResp.Macaroon == nil {
+		return nil, errors.New("invalid discharge response: missing macaroon")
+	}
+	return dischargeResp.Macaroon, nil
+}
+
+// promptTTY writes prompt to the controlling terminal and reads a line from
+// it.
+func promptTTY(prompt string) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+	_, err = fmt.Fprint(tty, prompt)
+	if err != nil {
+		return "", err
+	}
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+type totpEnrollCommand struct{}
+
+// NewTOTPEnrollCommand returns a Command that creates a TOTP secret for the
+// totp discharge checker.
+func NewTOTPEnrollCommand() *totpEnrollCommand {
+	return &totpEnrollCommand{}
+}
+
+// CLICommand implements Command.
+func (c *totpEnrollCommand) CLICommand() cli.Command {
+	return cli.Command{
+		Name:   "totp-enroll",
+		Usage:  "create a TOTP secret for an issuer, output its otpauth URI",
+		Action: Action(c),
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "home",
+				EnvVar: "OO_HOME",
+				Value:  defaultHome,
+			},
+		},
+	}
+}
+
+// Do implements Command.
+func (c *totpEnrollCommand) Do(ctx Context) error {
+	if len(ctx.Args()) != 1 {
+		ctx.ShowAppHelp()
+		return errors.New("usage: totp-enroll <issuer>")
+	}
+	issuer := ctx.Args()[0]
+	secretPath, err := totpSecretPath(ctx, issuer)
+	if err != nil {
+		return err
+	}
+	secret := make([]byte, 20)
+	_, err = rand.Reader.Read(secret)
+	if err != nil {
+		return err
+	}
+	encoded := base32.StdEncoding.EncodeToString(secret)
+	err = os.MkdirAll(filepath.Dir(secretPath), 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(secretPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot create secret for %q: %v", issuer, err)
+	}
+	_, err = fmt.Fprintln(f, encoded)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	uri := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer,
+		RawQuery: url.Values{"secret": {encoded}, "issuer": {issuer}}.Encode(),
+	}
+	_, err = fmt.Fprintln(ctx.Stdout(), uri.String())
+	return err
+}